@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net/netip"
+)
+
+// ACL decides which clients may make requests by their address
+type ACL struct {
+	Allow []netip.Prefix // Clients allowed, everyone when empty
+	Deny  []netip.Prefix // Clients refused even when allowed
+}
+
+// Permits reports whether a client at addr may make requests.  A deny entry
+// wins over an allow entry, and an empty allow list allows everyone not
+// denied.
+func (a *ACL) Permits(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range a.Deny {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	if len(a.Allow) == 0 {
+		return true
+	}
+	for _, prefix := range a.Allow {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -5,12 +5,19 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
+	"errors"
 	"hash/crc32"
 	"io"
 	"log"
 )
 
-func encrypt(plaintext []byte, key []byte) ([]byte, error) {
+// errCiphertextShort is returned for a sealed packet too short to carry a
+// nonce
+var errCiphertextShort = errors.New("ciphertext too short")
+
+// newAEAD sets up AES-GCM for a key.  A session does this once after the key
+// exchange and reuses the instance for every packet it seals or opens.
+func newAEAD(key []byte) (cipher.AEAD, error) {
 	// Create a new Cipher Block from the key
 	block, err := aes.NewCipher(key)
 	if err != nil {
@@ -18,52 +25,123 @@ func encrypt(plaintext []byte, key []byte) ([]byte, error) {
 	}
 
 	// Create a new Galois Counter Mode with the block cipher
-	aesGCM, err := cipher.NewGCM(block)
-	if err != nil {
-		return nil, err
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts a packet in place.  buf holds NonceSize bytes of room for
+// the nonce followed by the encoded packet, the returned slice holds the
+// nonce, the ciphertext and the tag and shares buf's storage when it has
+// room for the tag.
+func seal(aesGCM cipher.AEAD, buf []byte) ([]byte, error) {
+	nonceSize := aesGCM.NonceSize()
+	if cap(buf)-len(buf) < aesGCM.Overhead() {
+		grown := make([]byte, len(buf), len(buf)+aesGCM.Overhead())
+		copy(grown, buf)
+		buf = grown
 	}
 
 	// Create a nonce. Never use more than 2^32 random nonces with a given key
 	// because of the risk of a repeat.
-	nonce := make([]byte, aesGCM.NonceSize())
-	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+	nonce, plaintext := buf[:nonceSize], buf[nonceSize:]
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
 		return nil, err
 	}
 
-	// Encrypt the data using AES-GCM
-	ciphertext := aesGCM.Seal(nonce, nonce, plaintext, nil)
+	// Encrypt the data using AES-GCM over the plaintext
+	sealed := aesGCM.Seal(plaintext[:0], nonce, plaintext, nil)
+	return buf[:nonceSize+len(sealed)], nil
+}
+
+// open decrypts a sealed packet and appends the plaintext to dst.  The
+// sealed packet is left untouched so it can still be looked at when it
+// turns out not to be encrypted.
+func open(aesGCM cipher.AEAD, dst, ciphertext []byte) ([]byte, error) {
+	// Get the nonce size
+	nonceSize := aesGCM.NonceSize()
 
-	// Return the ciphertext
-	return ciphertext, nil
+	// Reject anything too short to even carry a nonce
+	if len(ciphertext) < nonceSize {
+		return nil, errCiphertextShort
+	}
+
+	// Split the ciphertext into the nonce and the encrypted data
+	nonce, ciphertext := ciphertext[:nonceSize], ciphertext[nonceSize:]
+
+	// Decrypt the data
+	return aesGCM.Open(dst, nonce, ciphertext, nil)
 }
 
-func decrypt(ciphertext []byte, key []byte) ([]byte, error) {
-	// Create a new Cipher Block from the key
-	block, err := aes.NewCipher(key)
+// encrypt seals plaintext with key into a new slice, setting up AES-GCM for
+// the one call
+func encrypt(plaintext []byte, key []byte) ([]byte, error) {
+	aesGCM, err := newAEAD(key)
 	if err != nil {
 		return nil, err
 	}
+	buf := make([]byte, aesGCM.NonceSize(), aesGCM.NonceSize()+len(plaintext)+aesGCM.Overhead())
+	return seal(aesGCM, append(buf, plaintext...))
+}
 
-	// Create a new Galois Counter Mode with the block cipher
-	aesGCM, err := cipher.NewGCM(block)
+// decrypt opens ciphertext with key into a new slice, setting up AES-GCM
+// for the one call
+func decrypt(ciphertext []byte, key []byte) ([]byte, error) {
+	aesGCM, err := newAEAD(key)
 	if err != nil {
 		return nil, err
 	}
+	return open(aesGCM, nil, ciphertext)
+}
 
-	// Get the nonce size
-	nonceSize := aesGCM.NonceSize()
+// encrypted reports whether packets on the session are sealed.  Plaintext
+// sessions and sessions that have not finished the key exchange are not.
+func (c *TFTPProtocol) encrypted() bool {
+	return !c.plain && c.dhke != nil && c.dhke.aead != nil
+}
 
-	// Split the ciphertext into the nonce and the encrypted data
-	nonce, ciphertext := ciphertext[:nonceSize], ciphertext[nonceSize:]
+// sealData frames a DATA packet for the session in its write buffer.
+// Encrypted sessions carry the checksum and are sealed with AES-GCM,
+// plaintext sessions use the plain RFC 1350 framing.
+func (c *TFTPProtocol) sealData(d *tftp.Data) ([]byte, error) {
+	if !c.encrypted() {
+		return d.AppendPlainTo((*c.writeBuf)[:0])
+	}
+	return c.sealPacket(d)
+}
 
-	// Decrypt the data
-	plaintext, err := aesGCM.Open(nil, nonce, ciphertext, nil)
+// sealPacket encodes a packet in the session's write buffer and seals it
+// unless the session is plaintext.  The result is only valid until the next
+// packet is sealed.
+func (c *TFTPProtocol) sealPacket(p tftp.Packet) ([]byte, error) {
+	if !c.encrypted() {
+		return p.AppendTo((*c.writeBuf)[:0])
+	}
+	buf, err := p.AppendTo((*c.writeBuf)[:c.dhke.aead.NonceSize()]) // Leave room for the nonce
 	if err != nil {
 		return nil, err
 	}
+	return seal(c.dhke.aead, buf)
+}
+
+// openPacket opens a packet received on the session, decrypting it into the
+// session's plaintext buffer unless the session is plaintext.  The result is
+// only valid until the next packet is opened.
+func (c *TFTPProtocol) openPacket(packet []byte) ([]byte, error) {
+	if !c.encrypted() {
+		return packet, nil
+	}
+	return open(c.dhke.aead, (*c.plainBuf)[:0], packet)
+}
 
-	// Return the plaintext
-	return plaintext, nil
+// decodeSession opens and decodes a packet received on the session with the
+// session's reused decoder.  Until the session has a key everything comes in
+// the clear, afterwards packets that do not authenticate are dropped, TERM
+// and ERROR included, so nobody but the peer can tear the session down.
+func (c *TFTPProtocol) decodeSession(raw []byte) (tftp.Packet, error) {
+	plain, err := c.openPacket(raw)
+	if err != nil {
+		return nil, err
+	}
+	return c.decoder.Decode(plain)
 }
 
 func AESTester() {
@@ -72,7 +150,7 @@ func AESTester() {
 
 	img, _ := ProxyRequest("https://rare-gallery.com/uploads/posts/577429-star-wars-high.jpg") // Get the image via HTTP
 
-	blocks, _ := PrepareData(img, 512, AES) // Prepare the data for encryption
+	blocks, _ := PrepareData(img, 512, 0, AES) // Prepare the data for encryption
 	log.Printf("Number of blocks: %d\n", len(blocks))
 
 	// Make a new slice of byte slices to hold the encrypted blocks
@@ -86,7 +164,7 @@ func AESTester() {
 	reformed := make([]byte, 0) // Create a new byte slice to hold the reformed image
 	for _, block := range encrypted {
 		pt, _ := decrypt(block, AES)              // Decrypt the block
-		data.Parse(pt, nil)                       // Parse the decrypted block into a data packet
+		data.Parse(pt)                            // Parse the decrypted block into a data packet
 		reformed = append(reformed, data.Data...) // Append the data to the reformed image
 	}
 
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"CSC445_Assignment2/tftp"
+	"strconv"
+	"testing"
+)
+
+// benchBlockSizes are the block sizes the packet benchmarks run with, the
+// RFC 1350 default and a large negotiated one
+var benchBlockSizes = []int{defaultBlockSize, 8192}
+
+// benchBlocks runs bench for each block size with a DATA packet of that size
+func benchBlocks(b *testing.B, bench func(b *testing.B, data *tftp.Data)) {
+	for _, size := range benchBlockSizes {
+		b.Run(strconv.Itoa(size), func(b *testing.B) {
+			data, err := tftp.NewData(1, make([]byte, size), nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.ReportAllocs()
+			b.SetBytes(int64(size))
+			bench(b, data)
+		})
+	}
+}
+
+// BenchmarkPerPacketCipher measures one DATA block and its ACK with the old
+// framing, which marshalled into new slices and set up AES-GCM again for
+// every packet
+func BenchmarkPerPacketCipher(b *testing.B) {
+	benchBlocks(b, benchPerPacketCipher)
+}
+
+// benchPerPacketCipher measures the old framing for data
+func benchPerPacketCipher(b *testing.B, data *tftp.Data) {
+	sender, receiver := benchSessions(b)
+	defer sender.releaseBuffers()
+	defer receiver.releaseBuffers()
+	key := sender.dhke.aes512Key
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sealed, _ := encrypt(data.ToBytes(), key)
+		opened, _ := decrypt(sealed, key)
+		received, _ := tftp.Decode(opened)
+		ack, _ := encrypt(tftp.NewAck(received.(*tftp.Data).BlockNumber).ToBytes(), key)
+		opened, _ = decrypt(ack, key)
+		if _, err := tftp.Decode(opened); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkSessionBuffers measures one DATA block and its ACK with the
+// session framing the transfer loops use, which encodes into pooled buffers
+// with one AES-GCM instance and decodes into reused packets
+func BenchmarkSessionBuffers(b *testing.B) {
+	benchBlocks(b, benchSessionBuffers)
+}
+
+// benchSessionBuffers measures the session framing for data
+func benchSessionBuffers(b *testing.B, data *tftp.Data) {
+	sender, receiver := benchSessions(b)
+	defer sender.releaseBuffers()
+	defer receiver.releaseBuffers()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sealed, _ := sender.sealData(data)
+		opened, _ := receiver.openPacket(sealed)
+		received, _ := receiver.decoder.Decode(opened)
+		receiver.ack.BlockNumber = received.(*tftp.Data).BlockNumber
+		ack, _ := receiver.sealPacket(&receiver.ack)
+		opened, _ = sender.openPacket(ack)
+		if _, err := sender.decoder.Decode(opened); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// benchSessions returns two sessions that completed a key exchange with
+// each other and hold their pooled buffers
+func benchSessions(b *testing.B) (sender, receiver *TFTPProtocol) {
+	b.Helper()
+	sender = &TFTPProtocol{dhke: new(DHKESession)}
+	receiver = &TFTPProtocol{dhke: new(DHKESession)}
+	sender.dhke.GenerateKeyPair()
+	receiver.dhke.GenerateKeyPair()
+	if _, err := sender.dhke.generateSharedKey(receiver.dhke.pubKeyX, receiver.dhke.pubKeyY); err != nil {
+		b.Fatalf("Error generating shared key: %s", err)
+	}
+	if _, err := receiver.dhke.generateSharedKey(sender.dhke.pubKeyX, sender.dhke.pubKeyY); err != nil {
+		b.Fatalf("Error generating shared key: %s", err)
+	}
+	sender.acquireBuffers()
+	receiver.acquireBuffers()
+	return sender, receiver
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"sync"
+)
+
+// maxDatagram is the largest packet either side sends, a sealed DATA packet
+// of the largest block size.  Pooled buffers are this size so they fit any
+// negotiated block size.
+const maxDatagram = maxBlockSize + dataHeaderSize + aeadOverhead
+
+// packetPool holds packet buffers between sessions so a new transfer does
+// not allocate its buffers from scratch
+var packetPool = sync.Pool{
+	New: func() any {
+		b := make([]byte, maxDatagram)
+		return &b
+	},
+}
+
+// getBuffer takes a packet buffer from the pool
+func getBuffer() *[]byte {
+	return packetPool.Get().(*[]byte)
+}
+
+// putBuffer returns a packet buffer to the pool
+func putBuffer(b *[]byte) {
+	*b = (*b)[:maxDatagram]
+	packetPool.Put(b)
+}
+
+// acquireBuffers takes the read, plaintext, write and block buffers a
+// transfer loop works in from the pool.  Calling it again while they are held is a no-op.
+func (c *TFTPProtocol) acquireBuffers() {
+	if c.readBuf != nil {
+		return
+	}
+	c.readBuf, c.plainBuf, c.writeBuf, c.blockBuf = getBuffer(), getBuffer(), getBuffer(), getBuffer()
+}
+
+// releaseBuffers returns the session's buffers to the pool.  Nothing may
+// hold on to a packet read, opened or sealed in them afterwards.
+func (c *TFTPProtocol) releaseBuffers() {
+	if c.readBuf == nil {
+		return
+	}
+	putBuffer(c.readBuf)
+	putBuffer(c.plainBuf)
+	putBuffer(c.writeBuf)
+	putBuffer(c.blockBuf)
+	c.readBuf, c.plainBuf, c.writeBuf, c.blockBuf = nil, nil, nil, nil
+}
@@ -2,12 +2,19 @@ package main
 
 import (
 	"CSC445_Assignment2/tftp"
-	"encoding/binary"
+	"errors"
 	"fmt"
 	"hash/crc32"
 	"log"
+	"math"
 	"math/big"
 	"net"
+	"time"
+)
+
+const (
+	maxRequestRetries = 5                // Times a request is resent before the server is given up on
+	maxRequestDelay   = 30 * time.Second // Longest wait for a reply to a request
 )
 
 // NewTFTPClient method constructs a new TFTPProtocol struct
@@ -16,39 +23,27 @@ func NewTFTPClient() (*TFTPProtocol, error) {
 	if err != nil {
 		return nil, err
 	}
-	conn, err := net.DialUDP("udp", nil, remoteAddr)
+	conn, err := net.ListenUDP("udp", nil) // Unconnected, the server answers from a new port
 	if err != nil {
 		return nil, err
 	}
 
-	return &TFTPProtocol{conn: conn, raddr: remoteAddr, xferSize: 0}, nil
+	return &TFTPProtocol{conn: conn, raddr: remoteAddr, xferSize: 0, mode: TransferMode}, nil
 }
 
-// RequestFile method sends a request packet to the server and begins the transfer process
+// RequestFile method sends a request packet to the server and begins the transfer process.
+// An ERROR sent by the server is returned as a *tftp.Error carrying its code and message.
 func (c *TFTPProtocol) RequestFile(url string) (data []byte, transTime float64, err error) {
-	defer func() { // Recover from panic in case of key generation failure
-		if r := recover(); r != nil {
-			log.Printf("Panic recovered in RequestFile: %v", r)
-			err = fmt.Errorf("panic: %v", r)
-		}
-	}()
 	log.Printf("Starting RequestFile\n")
 
-	c.dhke = new(DHKESession) // Make a new DHKE session
-	c.dhke.GenerateKeyPair()  // Generate the key pair
-
-	options := make(map[string][]byte)       // Create a map for the options
-	options["keyx"] = c.dhke.pubKeyX.Bytes() // Set the x public key to the map
-	options["keyy"] = c.dhke.pubKeyY.Bytes() // Set the y public key to the map
-
-	reqPack, _ := tftp.NewReq([]byte(url), []byte("octet"), 0, options)
-	packet, _ := reqPack.ToBytes()
-
-	c.SetProtocolOptions(options, 0) // Sets the protocol options
-	_, err = c.conn.Write(packet)    // Sends the request packet
+	options := c.requestOptions() // Start the key exchange and ask for our options
+	options.SetUint("tsize", 0)   // Ask the server for the file size
 
+	reqPack, err := tftp.NewReq([]byte(url), []byte(c.mode), 0, options)
 	if err != nil {
-		log.Printf("Error sending request packet: %s\n", err)
+		return nil, 0, err
+	}
+	if err = c.sendRequest(reqPack); err != nil { // Sends the request packet to the listening port
 		return nil, 0, err
 	}
 	err = c.preDataTransfer() // Starts the transfer process
@@ -58,57 +53,271 @@ func (c *TFTPProtocol) RequestFile(url string) (data []byte, transTime float64,
 		return nil, 0, err
 	}
 	data = c.rebuildData() // Rebuilds the data from the data packets received
+	if c.xferSize > 0 && len(data) != int(c.xferSize) {
+		return nil, 0, fmt.Errorf("received %d bytes, server announced %d", len(data), c.xferSize)
+	}
+	if c.mode == tftp.ModeNetascii {
+		data = tftp.FromNetascii(data) // Restore local line endings
+	}
 	return data, 0, nil
 }
 
+// UploadFile method sends a write request for data to the server and sends
+// the file once the server accepted it.  The server stores the file under
+// name after the last block, and only acknowledges the last block once the
+// file is stored.  An ERROR sent by the server is returned as a *tftp.Error
+// carrying its code and message.
+func (c *TFTPProtocol) UploadFile(name string, data []byte) error {
+	log.Printf("Starting UploadFile\n")
+	if c.mode == tftp.ModeNetascii {
+		data = tftp.ToNetascii(data) // The server sizes and stores the file as sent
+	}
+	if int64(len(data)) > math.MaxUint32 {
+		return fmt.Errorf("file of %d bytes is too large to announce in tsize", len(data))
+	}
+
+	options := c.requestOptions()               // Start the key exchange and ask for our options
+	options.SetUint("tsize", uint64(len(data))) // Tell the server how much to expect, even when it is nothing
+	reqPack, err := tftp.NewReq([]byte(name), []byte(c.mode), uint32(len(data)), options)
+	if err != nil {
+		return err
+	}
+	reqPack.Op = tftp.TFTPOpcodeWRQ               // An empty file is still a write
+	if err = c.sendRequest(reqPack); err != nil { // Sends the request packet to the listening port
+		return err
+	}
+	if err = c.negotiate(); err != nil {
+		log.Printf("Error negotiating upload: %s\n", err)
+		return err
+	}
+	c.content = newMemContent(data)                        // Sent block by block
+	err = c.sender(net.UDPAddrFromAddrPort(c.peer), false) // The OACK stands in for ACK 0
+	c.EndTime()
+	if err != nil {
+		log.Printf("Error in upload: %s\n", err)
+	}
+	return err
+}
+
+// sendRequest sends a request to the listening port of the server and
+// keeps it, should the server ask for it again with a cookie
+func (c *TFTPProtocol) sendRequest(req *tftp.Request) error {
+	c.request = req
+	packet, err := req.ToBytes()
+	if err != nil {
+		return err
+	}
+	if _, err = c.conn.WriteToUDP(packet, c.raddr); err != nil {
+		log.Printf("Error sending request packet: %s\n", err)
+		return err
+	}
+	return nil
+}
+
+// requestOptions starts a key exchange for a request and returns the
+// options every request asks for, our public key and transfer preferences
+func (c *TFTPProtocol) requestOptions() tftp.Options {
+	c.dhke = new(DHKESession) // Make a new DHKE session
+	c.dhke.GenerateKeyPair()  // Generate the key pair
+
+	options := make(tftp.Options)                     // Create a map for the options
+	options["keyx"] = c.dhke.pubKeyX.Bytes()          // Set the x public key to the map
+	options["keyy"] = c.dhke.pubKeyY.Bytes()          // Set the y public key to the map
+	options.SetUint("blksize", uint64(BlockSize))     // Request our preferred block size
+	options.SetUint("windowsize", uint64(WindowSize)) // Request our preferred window size
+	options.SetUint("timeout", uint64(Timeout))       // Request our retransmission timeout
+	options.SetUint("rollover", 0)                    // Let block numbers wrap to 0 on large files
+	if SelectiveRepeat {
+		options.SetUint("selrepeat", 1) // Ask to have only lost blocks resent
+		options.SetUint("sack", 1)      // and to report the blocks past a gap with SACKs
+	}
+	return options
+}
+
+// applyOack validates the servers OACK against the options we requested and
+// adopts the negotiated values.  The server may lower the block and window
+// sizes but not raise them, and has to echo the timeout unchanged.  Options
+// left out of the OACK fall back to the RFC 1350 defaults.
+func (c *TFTPProtocol) applyOack(oack *tftp.OptionAcknowledgement) error {
+	c.blockSize, c.windowSize, c.timeout = defaultBlockSize, defaultWindowSize, defaultTimeout
+	if oack.BlkSize != 0 {
+		if oack.BlkSize < minBlockSize || int(oack.BlkSize) > BlockSize {
+			return fmt.Errorf("server answered blksize %d, requested %d", oack.BlkSize, BlockSize)
+		}
+		c.blockSize = oack.BlkSize
+	}
+	if oack.Windowsize != 0 {
+		if int(oack.Windowsize) > WindowSize {
+			return fmt.Errorf("server answered windowsize %d, requested %d", oack.Windowsize, WindowSize)
+		}
+		c.windowSize = oack.Windowsize
+	}
+	if oack.Timeout != 0 {
+		if int(oack.Timeout) != Timeout {
+			return fmt.Errorf("server answered timeout %d, requested %d", oack.Timeout, Timeout)
+		}
+		c.timeout = time.Duration(oack.Timeout) * time.Second
+	}
+	c.rollover = 0
+	if v, ok := oack.Extensions.Uint("rollover"); ok && v != 0 {
+		return fmt.Errorf("server answered rollover %d, requested 0", v)
+	}
+	v, ok := oack.Extensions.Uint("selrepeat")
+	if ok && v == 1 && !SelectiveRepeat {
+		return fmt.Errorf("server answered selrepeat 1, not requested")
+	}
+	c.selective = ok && v == 1
+	v, ok = oack.Extensions.Uint("sack")
+	if ok && v == 1 && !c.selective {
+		return fmt.Errorf("server answered sack 1 without selective repeat")
+	}
+	c.sack = ok && v == 1 // Without it gaps are reported with plain ACKs
+	c.SetTransferSize(oack.XferSize)
+	log.Printf("Negotiated block size %d, window size %d, timeout %s, transfer size %d, selective repeat %t, sack %t\n",
+		c.blockSize, c.windowSize, c.timeout, c.xferSize, c.selective, c.sack)
+	return nil
+}
+
 // PreDataTransfer method handles the OACK packet and any error packets
 func (c *TFTPProtocol) preDataTransfer() error {
+	if err := c.negotiate(); err != nil {
+		return err
+	}
+	err, _ := c.receiver(true) // starts the transfer loop, returns error and bool
+	// signifying if the transfer is complete or not, and error would terminate the transfer
+	if err != nil {
+		return fmt.Errorf("error in transfer loop: %w", err)
+	}
+	c.ackLastBlock() // The whole file is in, let the server go
+	return nil
+}
+
+// negotiate reads the servers answer to our request.  An OACK is checked
+// against the options we asked for and completes the key exchange, an ERROR
+// or TERM from the server is returned.
+func (c *TFTPProtocol) negotiate() error {
 	packet := make([]byte, 1024)
-	err := error(nil)
-	n, tErr := c.conn.Read(packet)
-	if tErr != nil {
-		return fmt.Errorf("error reading packet: %s", err)
-	}
-	packet = packet[:n]
-	code := binary.BigEndian.Uint16(packet[:2])
-	switch tftp.TFTPOpcode(code) {
-	case tftp.TFTPOpcodeERROR:
-		log.Printf("Error packet received: %s\n", packet)
-		var errPack tftp.Error
-		errPack.Parse(packet)
-		// Sleep for 1 second to allow the server to close the connection
-		panic("Received Error Packet When Expecting OACK, assumed key exchange failed")
-	case tftp.TFTPOpcodeTERM:
-		log.Printf("Received Termination packet from server: %s\n", c.conn.RemoteAddr().String())
-		panic("Received Termination Packet When Expecting OACK, assumed key exchange failed")
-
-	case tftp.TFTPOpcodeOACK:
-		log.Printf("Received oack from server: %s\n", c.conn.RemoteAddr().String())
-		oackPack := new(tftp.OptionAcknowledgement)
-		err = oackPack.Parse(packet) // Parse the options packet which contains the server key pair
-		if err != nil {
-			c.sendError(0, "Error parsing OACK packet")
-			panic("Error parsing OACK packet")
+	n, err := c.requestReply(packet)
+	for tries := 0; err == nil; tries++ {
+		cookie := c.cookieChallenge(packet[:n])
+		if cookie == nil {
+			break
+		}
+		if tries == maxCookieTries {
+			return fmt.Errorf("server keeps asking for a cookie")
+		}
+		log.Printf("Echoing cookie from server: %s\n", c.peer)
+		c.request.Options["cookie"] = cookie // Prove we receive what is sent to our address
+		if err = c.sendRequest(c.request); err != nil {
+			return err
+		}
+		n, err = c.requestReply(packet)
+	}
+	if t := c.aborted(); t != nil {
+		return c.terminate(t.Reason) // Cancelled before the server answered
+	}
+	if err != nil {
+		return fmt.Errorf("error reading packet: %w", err)
+	}
+	decoded, err := tftp.Decode(packet[:n]) // Decode the reply to our request
+	if err != nil {
+		c.sendError(tftp.CodeMalformedPacket, "Error parsing OACK packet")
+		return fmt.Errorf("error parsing OACK packet: %w", err)
+	}
+	switch oackPack := decoded.(type) {
+	case *tftp.Error:
+		log.Printf("Error packet received: %d %s\n", oackPack.ErrorCode, oackPack.ErrorMessage)
+		return oackPack // Hand the servers error back to the caller
+	case *tftp.Term:
+		log.Printf("Received Termination packet from server: %s\n", c.peer)
+		return c.acknowledgeTerm(oackPack)
+
+	case *tftp.OptionAcknowledgement:
+		log.Printf("Received oack from server: %s\n", c.peer)
+		if err = c.applyOack(oackPack); err != nil { // Reject an OACK that does not answer our request
+			c.sendError(tftp.CodeOptionNegotiation, "Option negotiation failed")
+			return fmt.Errorf("error negotiating options: %w", err)
 		}
 		px, py := new(big.Int), new(big.Int) // create new big ints for the x and y values
 		px.SetBytes(oackPack.KeyX)           // convert x,y values into Big Ints
 		py.SetBytes(oackPack.KeyY)
 		c.dhke.sharedKey, err = c.dhke.generateSharedKey(px, py) // generate the shared key
-		if err != nil {                                          // if there is an error, send an error packet and panic
-			c.sendError(0, "Error generating shared key")
-			panic("Error generating shared key")
+		if err != nil {                                          // if there is an error, send an error packet and give up
+			c.sendError(tftp.CodeKeyExchange, "Error generating shared key")
+			return fmt.Errorf("error generating shared key: %w", err)
 		}
 		log.Printf("Shared Key: %d\n", crc32.ChecksumIEEE(c.dhke.sharedKey))
-
-		err, _ = c.TftpClientTransferLoop(c.conn) // starts the transfer loop, returns error and bool
-		// signifying if the transfer is complete or not, and error would terminate the transfer
-		if err != nil {
-			return fmt.Errorf("error in transfer loop: %s", err)
-		}
 	default:
-		log.Printf("Received unexpected packet: %s\n", packet)
+		log.Printf("Received unexpected %s packet\n", decoded.Opcode())
+		c.sendError(tftp.CodeIllegalOperation, "Expected OACK")
+		return fmt.Errorf("expected OACK, got %s", decoded.Opcode())
 	}
 
-	//
 	return nil
 }
+
+// requestReply waits for the servers reply to our request, resending the
+// request with exponential backoff when none arrives in time.  The server
+// answers a resent request from the session it already started for it.
+func (c *TFTPProtocol) requestReply(buf []byte) (int, error) {
+	defer c.conn.SetReadDeadline(time.Time{})
+	delay := time.Duration(Timeout) * time.Second
+	if delay <= 0 {
+		delay = defaultTimeout
+	}
+	for tries := 0; ; tries++ {
+		c.conn.SetReadDeadline(time.Now().Add(delay))
+		if c.aborted() != nil {
+			return 0, nil // Abort already woke us up, the caller tears down
+		}
+		n, err := c.awaitReply(buf)
+		var nErr net.Error
+		if !errors.As(err, &nErr) || !nErr.Timeout() || c.aborted() != nil {
+			return n, err
+		}
+		if tries == maxRequestRetries {
+			return n, fmt.Errorf("no reply to request after %d tries: %w", tries+1, err)
+		}
+		if delay *= 2; delay > maxRequestDelay {
+			delay = maxRequestDelay
+		}
+		log.Printf("No reply from %s, resending request\n", c.raddr)
+		if err = c.sendRequest(c.request); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// cookieChallenge returns the cookie of an OACK the listening port of the
+// server answered our request with, or nil when the packet is no cookie
+// challenge.  The answer to a request the server accepted comes from the
+// port of its session instead.
+func (c *TFTPProtocol) cookieChallenge(packet []byte) []byte {
+	if c.request == nil || c.peer != unmapped(c.raddr.AddrPort()) {
+		return nil
+	}
+	decoded, err := tftp.Decode(packet)
+	oack, ok := decoded.(*tftp.OptionAcknowledgement)
+	if err != nil || !ok {
+		return nil
+	}
+	return oack.Extensions["cookie"]
+}
+
+// awaitReply reads the servers first reply to our request.  The server
+// answers from the port of the session it started for us, its transfer ID,
+// and every later packet of the transfer has to come from there.
+func (c *TFTPProtocol) awaitReply(buf []byte) (int, error) {
+	server := unmapped(c.raddr.AddrPort())
+	for {
+		n, addr, err := c.conn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			return n, err
+		}
+		if addr = unmapped(addr); addr.Addr() == server.Addr() {
+			c.peer = addr
+			return n, nil
+		}
+		log.Printf("Ignoring packet from %s while waiting for %s\n", addr, server.Addr())
+	}
+}
@@ -0,0 +1,469 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/netip"
+	"os"
+	"sort"
+	"time"
+)
+
+// Config is the layout of the JSON config file.  Every setting is optional,
+// a setting left out keeps the value of its flag.
+//
+//	{
+//	  "mode": "server",
+//	  "listen": "0.0.0.0",
+//	  "port": 7500,
+//	  "window_size": 8,
+//	  "block_size": 1408,
+//	  "timeout": 1,
+//	  "retries": 5,
+//	  "selective_repeat": true,
+//	  "sessions": {"max": 64, "max_per_client": 4, "idle_timeout": 30, "drain_timeout": 10},
+//	  "sources": {"root": "/srv/tftp", "proxy": true, "mounts": {"fixtures/": "/srv/fixtures"}},
+//	  "uploads": {"dir": "/srv/uploads", "max_size": 67108864},
+//	  "acl": {"allow": ["10.0.0.0/8"], "deny": ["10.0.13.0/24"]},
+//	  "limits": {"requests_per_second": 100, "client_requests_per_second": 10, "bytes_per_second": 0, "client_bytes_per_second": 1048576, "require_cookie": true},
+//	  "crypto": {"forbid_plaintext": true},
+//	  "logging": {"file": "/var/log/tftp.log", "utc": true, "microseconds": false}
+//	}
+type Config struct {
+	Mode         *string `json:"mode"`
+	Address      *string `json:"address"`
+	Listen       *string `json:"listen"`
+	Port         *int    `json:"port"`
+	DropPackets  *bool   `json:"drop_packets"`
+	WindowSize   *int    `json:"window_size"`
+	BlockSize    *int    `json:"block_size"`
+	Timeout      *int    `json:"timeout"`
+	Retries      *int    `json:"retries"`
+	Selective    *bool   `json:"selective_repeat"`
+	TransferMode *string `json:"transfer_mode"`
+	Sessions     struct {
+		Max          *int `json:"max"`
+		MaxPerClient *int `json:"max_per_client"`
+		IdleTimeout  *int `json:"idle_timeout"`
+		DrainTimeout *int `json:"drain_timeout"`
+	} `json:"sessions"`
+	Sources struct {
+		Root   *string           `json:"root"`
+		Proxy  *bool             `json:"proxy"`
+		Mounts map[string]string `json:"mounts"` // Name prefix to directory
+	} `json:"sources"`
+	Uploads struct {
+		Dir     *string `json:"dir"`
+		MaxSize *int64  `json:"max_size"`
+	} `json:"uploads"`
+	ACL struct {
+		Allow []string `json:"allow"`
+		Deny  []string `json:"deny"`
+	} `json:"acl"`
+	Limits struct {
+		Requests       *float64 `json:"requests_per_second"`
+		ClientRequests *float64 `json:"client_requests_per_second"`
+		Bytes          *float64 `json:"bytes_per_second"`
+		ClientBytes    *float64 `json:"client_bytes_per_second"`
+		RequireCookie  *bool    `json:"require_cookie"`
+	} `json:"limits"`
+	Crypto struct {
+		ForbidPlaintext *bool `json:"forbid_plaintext"`
+	} `json:"crypto"`
+	Logging struct {
+		File         *string `json:"file"`
+		UTC          *bool   `json:"utc"`
+		Microseconds *bool   `json:"microseconds"`
+	} `json:"logging"`
+}
+
+// Settings are all settings of the program, from flags and the config file.
+// They are collected and validated as a whole before they are applied, so a
+// bad config file never leaves the program half configured.
+type Settings struct {
+	Mode              string
+	Address           string
+	Listen            string
+	Port              int
+	DropPax           bool
+	WindowSize        int
+	BlockSize         int
+	Timeout           int
+	Retries           int
+	SelectiveRepeat   bool
+	TransferMode      string
+	ForbidPlaintext   bool
+	MaxSessions       int
+	MaxClientSessions int
+	IdleTimeout       int
+	DrainTimeout      int
+	Root              string
+	Proxy             bool
+	Mounts            map[string]string
+	UploadDir         string
+	MaxUploadSize     int64
+	Allow             []netip.Prefix
+	Deny              []netip.Prefix
+	RequestRate       float64
+	ClientRequestRate float64
+	SendRate          float64
+	ClientSendRate    float64
+	RequireCookie     bool
+	LogFile           string
+	LogUTC            bool
+	LogMicroseconds   bool
+
+	keys map[string]string // Config keys settings were taken from, by flag name
+}
+
+// Settings that have no flag and can only be set in the config file
+var (
+	Proxy           = true // Fetch URLs over HTTP
+	Mounts          map[string]string
+	Allow           []netip.Prefix
+	Deny            []netip.Prefix
+	LogUTC          bool
+	LogMicroseconds bool
+)
+
+// defaultSettings returns the settings used when neither a flag nor the
+// config file sets them
+func defaultSettings() Settings {
+	return Settings{
+		Port:              7500,
+		WindowSize:        4,
+		BlockSize:         1024,
+		Timeout:           1,
+		Retries:           5,
+		TransferMode:      "octet",
+		MaxSessions:       64,
+		MaxClientSessions: 4,
+		IdleTimeout:       30,
+		DrainTimeout:      10,
+		Proxy:             true,
+		MaxUploadSize:     64 << 20,
+		ClientRequestRate: 10,
+	}
+}
+
+// loadSettings collects the settings from the flags and the config file and
+// validates them.  Flags given on the command line win over the file.
+func loadSettings() (Settings, error) {
+	s := flagValues
+	s.keys = make(map[string]string)
+	if ConfigFile == "" {
+		return s, s.validate()
+	}
+	cfg, err := readConfig(ConfigFile)
+	if err != nil {
+		return s, err
+	}
+	if err = s.merge(cfg); err != nil {
+		return s, err
+	}
+	return s, s.validate()
+}
+
+// readConfig reads and decodes a config file.  Unknown keys are an error so
+// a misspelt setting does not go unnoticed.
+func readConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading config file: %w", err)
+	}
+	cfg := new(Config)
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err = dec.Decode(cfg); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			return nil, fmt.Errorf("config key %q: expected %s, got %s", typeErr.Field, typeErr.Type, typeErr.Value)
+		}
+		return nil, fmt.Errorf("config file %s: %w", path, err)
+	}
+	if dec.More() {
+		return nil, fmt.Errorf("config file %s: trailing data after the settings", path)
+	}
+	return cfg, nil
+}
+
+// merge takes the settings of the config file whose flags were not given on
+// the command line
+func (s *Settings) merge(cfg *Config) error {
+	take(s, &s.Mode, cfg.Mode, "Mode", "mode")
+	take(s, &s.Address, cfg.Address, "Address", "address")
+	take(s, &s.Listen, cfg.Listen, "Listen", "listen")
+	take(s, &s.Port, cfg.Port, "Port", "port")
+	take(s, &s.DropPax, cfg.DropPackets, "DropPax", "drop_packets")
+	take(s, &s.WindowSize, cfg.WindowSize, "WindowSize", "window_size")
+	take(s, &s.BlockSize, cfg.BlockSize, "BlockSize", "block_size")
+	take(s, &s.Timeout, cfg.Timeout, "Timeout", "timeout")
+	take(s, &s.Retries, cfg.Retries, "Retries", "retries")
+	take(s, &s.SelectiveRepeat, cfg.Selective, "SelectiveRepeat", "selective_repeat")
+	take(s, &s.TransferMode, cfg.TransferMode, "TransferMode", "transfer_mode")
+	take(s, &s.MaxSessions, cfg.Sessions.Max, "MaxSessions", "sessions.max")
+	take(s, &s.MaxClientSessions, cfg.Sessions.MaxPerClient, "MaxClientSessions", "sessions.max_per_client")
+	take(s, &s.IdleTimeout, cfg.Sessions.IdleTimeout, "IdleTimeout", "sessions.idle_timeout")
+	take(s, &s.DrainTimeout, cfg.Sessions.DrainTimeout, "DrainTimeout", "sessions.drain_timeout")
+	take(s, &s.Root, cfg.Sources.Root, "Root", "sources.root")
+	take(s, &s.Proxy, cfg.Sources.Proxy, "Proxy", "sources.proxy")
+	take(s, &s.UploadDir, cfg.Uploads.Dir, "UploadDir", "uploads.dir")
+	take(s, &s.MaxUploadSize, cfg.Uploads.MaxSize, "MaxUploadSize", "uploads.max_size")
+	take(s, &s.RequestRate, cfg.Limits.Requests, "RequestRate", "limits.requests_per_second")
+	take(s, &s.ClientRequestRate, cfg.Limits.ClientRequests, "ClientRequestRate", "limits.client_requests_per_second")
+	take(s, &s.SendRate, cfg.Limits.Bytes, "SendRate", "limits.bytes_per_second")
+	take(s, &s.ClientSendRate, cfg.Limits.ClientBytes, "ClientSendRate", "limits.client_bytes_per_second")
+	take(s, &s.RequireCookie, cfg.Limits.RequireCookie, "RequireCookie", "limits.require_cookie")
+	take(s, &s.ForbidPlaintext, cfg.Crypto.ForbidPlaintext, "ForbidPlaintext", "crypto.forbid_plaintext")
+	take(s, &s.LogFile, cfg.Logging.File, "LogFile", "logging.file")
+	take(s, &s.LogUTC, cfg.Logging.UTC, "LogUTC", "logging.utc")
+	take(s, &s.LogMicroseconds, cfg.Logging.Microseconds, "LogMicroseconds", "logging.microseconds")
+	s.Mounts = cfg.Sources.Mounts
+
+	var err error
+	if s.Allow, err = parsePrefixes(cfg.ACL.Allow, "acl.allow"); err != nil {
+		return err
+	}
+	if s.Deny, err = parsePrefixes(cfg.ACL.Deny, "acl.deny"); err != nil {
+		return err
+	}
+	return nil
+}
+
+// take sets a setting from the config file unless the file leaves it out or
+// its flag was given on the command line, and remembers the key it came
+// from for error messages
+func take[T any](s *Settings, setting *T, value *T, flagName, key string) {
+	if value == nil || explicitFlags[flagName] {
+		return
+	}
+	*setting = *value
+	s.keys[flagName] = key
+}
+
+// parsePrefixes parses the CIDR prefixes of an ACL list.  A bare address is
+// a prefix covering just that address.
+func parsePrefixes(list []string, key string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(list))
+	for i, v := range list {
+		prefix, err := netip.ParsePrefix(v)
+		if err != nil {
+			addr, aErr := netip.ParseAddr(v)
+			if aErr != nil {
+				return nil, fmt.Errorf("config key %q: entry %d: %w", key, i, err)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// key names where a setting came from, its config key or its flag
+func (s *Settings) key(flagName string) string {
+	if key, ok := s.keys[flagName]; ok {
+		return fmt.Sprintf("config key %q", key)
+	}
+	return "flag -" + flagName
+}
+
+// validate checks the settings, errors name the config key or flag of the
+// bad setting
+func (s *Settings) validate() error {
+	switch {
+	case s.Mode == "client" && s.Address == "":
+		return fmt.Errorf("%s: Address must be specified for client mode", s.key("Address"))
+	case s.Listen != "" && !validAddr(s.Listen):
+		return fmt.Errorf("%s: %q is not an IP address", s.key("Listen"), s.Listen)
+	case s.Port < 0 || s.Port > 65535:
+		return fmt.Errorf("%s: Port must be between 0 and 65535", s.key("Port"))
+	case s.WindowSize < 1 || s.WindowSize > maxWindowSize:
+		return fmt.Errorf("%s: WindowSize must be between 1 and %d", s.key("WindowSize"), maxWindowSize)
+	case s.BlockSize < minBlockSize || s.BlockSize > maxBlockSize:
+		return fmt.Errorf("%s: BlockSize must be between %d and %d", s.key("BlockSize"), minBlockSize, maxBlockSize)
+	case s.Timeout < minTimeout || s.Timeout > maxTimeout:
+		return fmt.Errorf("%s: Timeout must be between %d and %d seconds", s.key("Timeout"), minTimeout, maxTimeout)
+	case s.Retries < 0:
+		return fmt.Errorf("%s: Retries must not be negative", s.key("Retries"))
+	case s.TransferMode != "octet" && s.TransferMode != "netascii":
+		return fmt.Errorf("%s: TransferMode must be 'octet' or 'netascii'", s.key("TransferMode"))
+	case s.MaxSessions < 0:
+		return fmt.Errorf("%s: session limits must not be negative", s.key("MaxSessions"))
+	case s.MaxClientSessions < 0:
+		return fmt.Errorf("%s: session limits must not be negative", s.key("MaxClientSessions"))
+	case s.IdleTimeout < 0:
+		return fmt.Errorf("%s: IdleTimeout must not be negative", s.key("IdleTimeout"))
+	case s.DrainTimeout < 0:
+		return fmt.Errorf("%s: DrainTimeout must not be negative", s.key("DrainTimeout"))
+	case s.MaxUploadSize < 0:
+		return fmt.Errorf("%s: MaxUploadSize must not be negative", s.key("MaxUploadSize"))
+	case s.RequestRate < 0:
+		return fmt.Errorf("%s: rate limits must not be negative", s.key("RequestRate"))
+	case s.ClientRequestRate < 0:
+		return fmt.Errorf("%s: rate limits must not be negative", s.key("ClientRequestRate"))
+	case s.SendRate < 0:
+		return fmt.Errorf("%s: rate limits must not be negative", s.key("SendRate"))
+	case s.ClientSendRate < 0:
+		return fmt.Errorf("%s: rate limits must not be negative", s.key("ClientSendRate"))
+	}
+	for prefix, dir := range s.Mounts {
+		if prefix == "" || dir == "" {
+			return fmt.Errorf("config key %q: mounts need a prefix and a directory", "sources.mounts")
+		}
+	}
+	return nil
+}
+
+// validAddr reports whether s is an IP address
+func validAddr(s string) bool {
+	_, err := netip.ParseAddr(s)
+	return err == nil
+}
+
+// apply makes the settings the ones the program runs with
+func (s *Settings) apply() {
+	Mode, Address, Listen, Port, DropPax = s.Mode, s.Address, s.Listen, s.Port, s.DropPax
+	WindowSize, BlockSize, Timeout, TransferMode = s.WindowSize, s.BlockSize, s.Timeout, s.TransferMode
+	Retries, SelectiveRepeat = s.Retries, s.SelectiveRepeat
+	MaxSessions, MaxClientSessions, IdleTimeout, DrainTimeout = s.MaxSessions, s.MaxClientSessions, s.IdleTimeout, s.DrainTimeout
+	Root, Proxy, Mounts = s.Root, s.Proxy, s.Mounts
+	UploadDir, MaxUploadSize = s.UploadDir, s.MaxUploadSize
+	Allow, Deny, ForbidPlaintext = s.Allow, s.Deny, s.ForbidPlaintext
+	RequestRate, ClientRequestRate, SendRate, ClientSendRate = s.RequestRate, s.ClientRequestRate, s.SendRate, s.ClientSendRate
+	RequireCookie = s.RequireCookie
+	LogFile, LogUTC, LogMicroseconds = s.LogFile, s.LogUTC, s.LogMicroseconds
+}
+
+// logOutput is the log file currently written to, nil for standard error
+var logOutput *os.File
+
+// configureLogging points the log at the configured file, opening it again
+// so a rotated log is picked up on reload
+func configureLogging() error {
+	var out io.Writer = os.Stderr
+	var file *os.File
+	if LogFile != "" {
+		var err error
+		file, err = os.OpenFile(LogFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+		if err != nil {
+			return fmt.Errorf("%s: %w", "log file", err)
+		}
+		out = file
+	}
+	flags := log.LstdFlags
+	if LogUTC {
+		flags |= log.LUTC
+	}
+	if LogMicroseconds {
+		flags |= log.Lmicroseconds
+	}
+	log.SetOutput(out)
+	log.SetFlags(flags)
+	if logOutput != nil {
+		logOutput.Close()
+	}
+	logOutput = file
+	return nil
+}
+
+// serverSettings are the settings of a running server that a reload can
+// change.  Sessions take the settings current when they start and keep
+// them, so a reload never changes a transfer in flight.
+type serverSettings struct {
+	blockSize       int          // Largest block size accepted
+	windowSize      int          // Largest window size accepted
+	retries         int          // Times a block is sent again before a transfer is given up on
+	forbidPlaintext bool         // Refuse sessions without key exchange
+	maxUploadSize   int64        // Largest upload accepted, 0 for no limit
+	source          Source       // Where requested files are opened
+	storage         Storage      // Where uploads are committed, nil when they are refused
+	acl             *ACL         // Clients allowed to make requests
+	limiter         *RateLimiter // Request and send rate limits, nil for none
+	requireCookie   bool         // Answer requests with a cookie before serving them
+}
+
+// newServerSettings builds the server settings from the current settings
+func newServerSettings() (*serverSettings, error) {
+	settings := &serverSettings{
+		blockSize:       BlockSize,
+		windowSize:      WindowSize,
+		retries:         Retries,
+		forbidPlaintext: ForbidPlaintext,
+		maxUploadSize:   MaxUploadSize,
+		source:          defaultSources(),
+		acl:             &ACL{Allow: Allow, Deny: Deny},
+		limiter:         NewRateLimiter(RequestRate, ClientRequestRate, SendRate, ClientSendRate),
+		requireCookie:   RequireCookie,
+	}
+	if UploadDir != "" {
+		storage, err := NewDirStorage(UploadDir)
+		if err != nil {
+			return nil, fmt.Errorf("opening upload directory: %w", err)
+		}
+		settings.storage = storage
+	}
+	return settings, nil
+}
+
+// reload reads the config file again and applies the settings that can
+// change while the server runs: limits, sources, uploads, ACLs, rate
+// limits, crypto policy and logging.  Rate limit buckets start over full.
+// Where the server listens can only change with a restart.  A config file
+// that does not validate is rejected as a whole and the server keeps its
+// settings.
+func (c *TFTPProtocol) reload() error {
+	s, err := loadSettings()
+	if err != nil {
+		return err
+	}
+	if s.Mode != Mode || s.Listen != Listen || s.Port != Port {
+		log.Printf("Warning: mode and listen address changes need a restart, keeping %s on %s:%d\n", Mode, Listen, Port)
+		s.Mode, s.Listen, s.Port = Mode, Listen, Port
+	}
+	old := currentSettings()
+	s.apply()
+	settings, err := newServerSettings()
+	if err == nil {
+		err = configureLogging()
+	}
+	if err != nil {
+		old.apply() // Keep running with what we had
+		return err
+	}
+	c.settings.Store(settings)
+	c.sessions.SetLimits(MaxSessions, MaxClientSessions, time.Duration(IdleTimeout)*time.Second)
+	log.Printf("Configuration reloaded: %s\n", describeSettings())
+	return nil
+}
+
+// currentSettings returns the settings the program runs with
+func currentSettings() Settings {
+	return Settings{
+		Mode: Mode, Address: Address, Listen: Listen, Port: Port, DropPax: DropPax,
+		WindowSize: WindowSize, BlockSize: BlockSize, Timeout: Timeout, TransferMode: TransferMode, Retries: Retries,
+		SelectiveRepeat: SelectiveRepeat,
+		MaxSessions:     MaxSessions, MaxClientSessions: MaxClientSessions, IdleTimeout: IdleTimeout, DrainTimeout: DrainTimeout,
+		Root: Root, Proxy: Proxy, Mounts: Mounts, UploadDir: UploadDir, MaxUploadSize: MaxUploadSize,
+		Allow: Allow, Deny: Deny, ForbidPlaintext: ForbidPlaintext,
+		RequestRate: RequestRate, ClientRequestRate: ClientRequestRate, SendRate: SendRate, ClientSendRate: ClientSendRate,
+		RequireCookie: RequireCookie,
+		LogFile:       LogFile, LogUTC: LogUTC, LogMicroseconds: LogMicroseconds,
+	}
+}
+
+// describeSettings summarises the reloadable settings for the log
+func describeSettings() string {
+	mounts := make([]string, 0, len(Mounts))
+	for prefix := range Mounts {
+		mounts = append(mounts, prefix)
+	}
+	sort.Strings(mounts)
+	return fmt.Sprintf("block size %d, window size %d, sessions %d/%d per client, idle timeout %ds, root %q, mounts %v, "+
+		"uploads %q, %d allowed and %d denied prefixes, %g/%g requests/s, %g/%g bytes/s, cookies %t",
+		BlockSize, WindowSize, MaxSessions, MaxClientSessions, IdleTimeout, Root, mounts, UploadDir, len(Allow), len(Deny),
+		RequestRate, ClientRequestRate, SendRate, ClientSendRate, RequireCookie)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Congestion control after RFC 5681, counted in blocks rather than bytes
+const (
+	initialWindow = 2 // Blocks a sender may have in flight before any ACK
+	dupAckLimit   = 3 // ACKs pointing at a lost block before it is sent again early
+)
+
+// CongestionStats are the congestion window statistics of a sending session
+type CongestionStats struct {
+	Window   float64 // Blocks allowed in flight
+	SSThresh float64 // Window slow start ends at
+	Limit    int     // Negotiated windowsize the window never exceeds
+	Peak     int     // Largest window reached
+	Cuts     int     // Times a lost block halved the window
+	Collapse int     // Times a timeout closed the window to one block
+}
+
+// String formats the statistics for the log
+func (s CongestionStats) String() string {
+	if s.Limit == 0 {
+		return "none, not sending"
+	}
+	return fmt.Sprintf("cwnd %.1f of %d, ssthresh %.1f, peak %d, %d cuts, %d collapses",
+		s.Window, s.Limit, s.SSThresh, s.Peak, s.Cuts, s.Collapse)
+}
+
+// congestionWindow adapts how many blocks a sender keeps in flight.  The
+// window opens by a block per ACK in slow start and by a block per window
+// in congestion avoidance, halves when the receiver signals a lost block and
+// closes to one block when the retransmission timer expires.  It never
+// exceeds the negotiated windowsize.  The transfer loop updates it, the
+// session manager reads it from other goroutines.
+type congestionWindow struct {
+	mu      sync.Mutex
+	recover int // Highest block sent when the window was last cut
+	CongestionStats
+}
+
+// reset starts slow start over for a negotiated windowsize of limit
+func (w *congestionWindow) reset(limit uint16) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.recover = 0
+	w.CongestionStats = CongestionStats{Window: initialWindow, SSThresh: float64(limit), Limit: int(limit)}
+	w.clamp()
+}
+
+// size returns the number of blocks allowed in flight
+func (w *congestionWindow) size() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return int(w.Window)
+}
+
+// acked opens the window for n newly acknowledged blocks
+func (w *congestionWindow) acked(n int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for ; n > 0; n-- {
+		if w.Window < w.SSThresh {
+			w.Window++ // Slow start
+		} else {
+			w.Window += 1 / w.Window // Congestion avoidance
+		}
+	}
+	w.clamp()
+}
+
+// lost halves the window after the receiver signalled that base was lost,
+// with blocks up to highest in flight.  Losses among the blocks in flight
+// when the window was last cut are part of the same congestion event, so it
+// reports whether the window was cut.
+func (w *congestionWindow) lost(base, highest int) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if base <= w.recover {
+		return false
+	}
+	w.recover = highest
+	w.SSThresh = w.half()
+	w.Window = w.SSThresh
+	w.Cuts++
+	w.clamp()
+	return true
+}
+
+// timeout closes the window to one block after the retransmission timer
+// expired with blocks up to highest in flight
+func (w *congestionWindow) timeout(highest int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.recover = highest
+	w.SSThresh = w.half()
+	w.Window = 1
+	w.Collapse++
+}
+
+// stats returns a snapshot of the statistics
+func (w *congestionWindow) stats() CongestionStats {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.CongestionStats
+}
+
+// half returns half the window, but at least two blocks
+func (w *congestionWindow) half() float64 {
+	if h := w.Window / 2; h > 2 {
+		return h
+	}
+	return 2
+}
+
+// clamp keeps the window within the negotiated windowsize and tracks its
+// peak
+func (w *congestionWindow) clamp() {
+	if w.Window > float64(w.Limit) {
+		w.Window = float64(w.Limit)
+	}
+	if int(w.Window) > w.Peak {
+		w.Peak = int(w.Window)
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"CSC445_Assignment2/tftp"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrOutsideRoot is returned for local paths that would leave the served
+// directory
+var ErrOutsideRoot = errors.New("path leaves the served directory")
+
+// ErrNoRoot is returned for local paths when no directory is served
+var ErrNoRoot = errors.New("local files are not served")
+
+// Content is a file being sent.  The sender reads it block by block as the
+// blocks go out, so a file on disk is never loaded as a whole.
+type Content interface {
+	io.ReaderAt
+	io.Closer
+	Size() int64 // Size of the file in bytes
+}
+
+// memContent is a file held in memory
+type memContent struct {
+	*bytes.Reader
+}
+
+// newMemContent makes data sendable as Content
+func newMemContent(data []byte) Content {
+	return memContent{bytes.NewReader(data)}
+}
+
+// Close does nothing, there is nothing to release
+func (memContent) Close() error {
+	return nil
+}
+
+// fileContent is a file on disk
+type fileContent struct {
+	*os.File
+	size    int64
+	modTime time.Time
+}
+
+// Size returns the size the file had when it was opened
+func (f fileContent) Size() int64 {
+	return f.size
+}
+
+// ModTime returns the modification time the file had when it was opened
+func (f fileContent) ModTime() time.Time {
+	return f.modTime
+}
+
+// openLocal opens the regular file name under root for reading.  name is a
+// slash separated path relative to root.  Absolute paths, .. components and
+// symlinks that resolve outside of root are refused.
+func openLocal(root, name string) (fileContent, error) {
+	if root == "" {
+		return fileContent{}, ErrNoRoot
+	}
+	if name == "" || strings.HasPrefix(name, "/") || strings.ContainsAny(name, "\\\x00") || filepath.IsAbs(name) {
+		return fileContent{}, ErrOutsideRoot
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return fileContent{}, ErrOutsideRoot
+		}
+	}
+
+	// Resolve symlinks on both sides so a link can not point the path
+	// outside of the root
+	base, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return fileContent{}, err
+	}
+	path, err := filepath.EvalSymlinks(filepath.Join(base, filepath.FromSlash(name)))
+	if err != nil {
+		return fileContent{}, err
+	}
+	if rel, err := filepath.Rel(base, path); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fileContent{}, ErrOutsideRoot
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return fileContent{}, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fileContent{}, err
+	}
+	// The path could have been swapped for a symlink between resolving and
+	// opening it, make sure the file opened is still the one checked
+	if linfo, err := os.Lstat(path); err != nil || !os.SameFile(info, linfo) {
+		file.Close()
+		return fileContent{}, ErrOutsideRoot
+	}
+	if !info.Mode().IsRegular() {
+		file.Close()
+		return fileContent{}, fmt.Errorf("%s is not a regular file: %w", name, os.ErrNotExist)
+	}
+	return fileContent{File: file, size: info.Size(), modTime: info.ModTime()}, nil
+}
+
+// netasciiContent is a file translated to netascii as its blocks are read.
+// The translation grows the file, so it keeps the translated offset every
+// chunk of the source starts at and translates a read from the chunk it
+// starts in.  It reuses its buffers and is only read by one transfer loop.
+type netasciiContent struct {
+	src    Content
+	chunk  int64   // Bytes of the source translated at once
+	starts []int64 // Translated offset each chunk starts at
+	size   int64   // Size of the translated file
+	buf    []byte  // Chunk of the source read
+	out    []byte  // Its translation
+}
+
+// newNetasciiContent translates src to netascii in chunks of chunk bytes.
+// It reads the file once to size the translation.
+func newNetasciiContent(src Content, chunk int) (*netasciiContent, error) {
+	n := &netasciiContent{src: src, chunk: int64(chunk), buf: make([]byte, chunk)}
+	for off := int64(0); off < src.Size(); off += n.chunk {
+		data, err := n.readChunk(len(n.starts))
+		if err != nil {
+			return nil, err
+		}
+		n.starts = append(n.starts, n.size)
+		n.size += int64(len(data) + bytes.Count(data, []byte{'\n'}) + bytes.Count(data, []byte{'\r'}))
+	}
+	return n, nil
+}
+
+// readChunk reads chunk i of the source
+func (n *netasciiContent) readChunk(i int) ([]byte, error) {
+	off := int64(i) * n.chunk
+	size := n.src.Size() - off
+	if size > n.chunk {
+		size = n.chunk
+	}
+	buf := n.buf[:size]
+	if read, err := n.src.ReadAt(buf, off); read < len(buf) {
+		return nil, fmt.Errorf("reading offset %d: %w", off, err)
+	}
+	return buf, nil
+}
+
+// ReadAt reads len(p) bytes of the translated file starting at off
+func (n *netasciiContent) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	}
+	i := sort.Search(len(n.starts), func(i int) bool { return n.starts[i] > off }) - 1
+	read := 0
+	for ; read < len(p) && i >= 0 && i < len(n.starts); i++ {
+		data, err := n.readChunk(i)
+		if err != nil {
+			return read, err
+		}
+		n.out = tftp.AppendNetascii(n.out[:0], data)
+		read += copy(p[read:], n.out[off+int64(read)-n.starts[i]:])
+	}
+	if read < len(p) {
+		return read, io.EOF
+	}
+	return read, nil
+}
+
+// Size returns the size of the translated file
+func (n *netasciiContent) Size() int64 {
+	return n.size
+}
+
+// Close closes the source
+func (n *netasciiContent) Close() error {
+	return n.src.Close()
+}
+
+// blockCount returns how many DATA blocks the content is sent in.  A file
+// that is an exact multiple of the block size ends with an empty block so
+// the receiver can tell the transfer is complete.
+func (c *TFTPProtocol) blockCount() int {
+	return int(c.content.Size()/int64(c.blockSize)) + 1
+}
+
+// readBlock reads block n, counted from 1, of the content into the
+// session's reused DATA packet.  The packet is only valid until the next
+// block is read.
+func (c *TFTPProtocol) readBlock(n int) (*tftp.Data, error) {
+	offset := int64(n-1) * int64(c.blockSize)
+	size := c.content.Size() - offset
+	if size > int64(c.blockSize) {
+		size = int64(c.blockSize)
+	}
+	buf := (*c.blockBuf)[:size]
+	if read, err := c.content.ReadAt(buf, offset); read < len(buf) {
+		return nil, fmt.Errorf("reading block %d: %w", n, err)
+	}
+	c.block.BlockNumber = tftp.WireBlock(uint64(n), c.rollover)
+	c.block.Checksum = tftp.Checksum(buf)
+	c.block.Data = buf
+	return &c.block, nil
+}
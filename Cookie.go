@@ -0,0 +1,63 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"net/netip"
+	"time"
+)
+
+const (
+	cookieLifetime = 30 * time.Second // How long a client has to echo a cookie
+	cookieMACSize  = 16               // Bytes of the truncated HMAC-SHA256
+	cookieSize     = 8 + cookieMACSize
+	maxCookieTries = 2 // Cookie challenges a client answers before giving up on a request
+)
+
+// CookieJar issues and checks return-routability cookies.  A cookie is the
+// time it was issued and a MAC over that time and the client address and
+// port, so a client can only echo one if it receives packets sent to the
+// address it claims.  The server keeps no state per cookie.
+type CookieJar struct {
+	secret [32]byte
+}
+
+// NewCookieJar creates a cookie jar with a random secret
+func NewCookieJar() (*CookieJar, error) {
+	jar := new(CookieJar)
+	if _, err := rand.Read(jar.secret[:]); err != nil {
+		return nil, err
+	}
+	return jar, nil
+}
+
+// Issue returns a cookie for a client at addr
+func (j *CookieJar) Issue(addr netip.AddrPort, now time.Time) []byte {
+	cookie := binary.BigEndian.AppendUint64(make([]byte, 0, cookieSize), uint64(now.Unix()))
+	return append(cookie, j.mac(addr, cookie)...)
+}
+
+// Verify reports whether cookie was issued to a client at addr and has not
+// expired
+func (j *CookieJar) Verify(addr netip.AddrPort, cookie []byte, now time.Time) bool {
+	if len(cookie) != cookieSize {
+		return false
+	}
+	issued := time.Unix(int64(binary.BigEndian.Uint64(cookie)), 0)
+	if age := now.Sub(issued); age < -time.Second || age > cookieLifetime {
+		return false
+	}
+	return hmac.Equal(cookie[8:], j.mac(addr, cookie[:8]))
+}
+
+// mac computes the MAC of a cookie issued at stamp to addr
+func (j *CookieJar) mac(addr netip.AddrPort, stamp []byte) []byte {
+	h := hmac.New(sha256.New, j.secret[:])
+	h.Write(stamp)
+	ip := addr.Addr().Unmap().As16()
+	h.Write(ip[:])
+	h.Write(binary.BigEndian.AppendUint16(nil, addr.Port()))
+	return h.Sum(nil)[:cookieMACSize]
+}
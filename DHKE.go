@@ -2,6 +2,7 @@ package main
 
 import (
 	"CSC445_Assignment2/tftp"
+	"crypto/cipher"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
@@ -17,6 +18,7 @@ type DHKESession struct {
 	pubKeyY    *big.Int
 	sharedKey  []byte
 	aes512Key  []byte
+	aead       cipher.AEAD // AES-GCM for aes512Key, set up once per session
 }
 
 // GenerateKeyPair a public-private key pair for the DHKE using the elliptic curve P-256.
@@ -64,6 +66,11 @@ func (d *DHKESession) generateSharedKey(pubKeyX, pubKeyY *big.Int) ([]byte, erro
 
 	// Derive the AES key from the shared secret using SHA-256
 	d.aes512Key = deriveAESKey256(x.Bytes())
+	aesGCM, err := newAEAD(d.aes512Key)
+	if err != nil {
+		return nil, err
+	}
+	d.aead = aesGCM
 	// Return the shared secret as bytes in case we want to use it for something else
 	return x.Bytes(), nil
 }
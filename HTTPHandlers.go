@@ -1,6 +1,8 @@
 package main
 
 import (
+	"CSC445_Assignment2/tftp"
+	"errors"
 	"log"
 	"net/http"
 
@@ -40,16 +42,59 @@ func getImage2(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 		return
 	}
 	defer client.Close()
+	if mode := r.URL.Query().Get("mode"); mode != "" {
+		client.mode = mode // Allow text resources to be fetched in netascii
+	}
 
-	var img []byte
-	func() {
-		img, _, err = client.RequestFile(imageUrl) // request the file via url
-		if err != nil {
-			log.Printf("Error Requesting File over TFTP: %s\n", err)
+	// Tear the transfer down with a TERM when the browser goes away
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-r.Context().Done():
+			client.Abort(tftp.TermCancelled)
+		case <-done:
 		}
 	}()
 
-	w.Header().Set("Content-Type", "image/jpeg") // set the content type
+	var img []byte
+	img, _, err = client.RequestFile(imageUrl) // request the file via url
+	if err != nil {
+		log.Printf("Error Requesting File over TFTP: %s\n", err)
+		http.Error(w, err.Error(), httpStatus(err))
+		return
+	}
+
+	if client.mode == "netascii" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", "image/jpeg") // set the content type
+	}
 	w.Write(img)
 
 }
+
+// httpStatus maps the TFTP error returned by the server onto an HTTP status
+// code, anything that is not a TFTP error is reported as a bad gateway
+func httpStatus(err error) int {
+	var term *tftp.Term
+	if errors.As(err, &term) && term.Reason == tftp.TermShutdown {
+		return http.StatusServiceUnavailable // The server went away mid transfer
+	}
+	var tftpErr *tftp.Error
+	if !errors.As(err, &tftpErr) {
+		return http.StatusBadGateway
+	}
+	switch tftpErr.ErrorCode {
+	case tftp.CodeFileNotFound:
+		return http.StatusNotFound
+	case tftp.CodeAccessViolation:
+		return http.StatusForbidden
+	case tftp.CodeDiskFull:
+		return http.StatusRequestEntityTooLarge
+	case tftp.CodeIllegalOperation, tftp.CodeOptionNegotiation:
+		return http.StatusBadRequest
+	default:
+		return http.StatusBadGateway
+	}
+}
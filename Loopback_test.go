@@ -0,0 +1,375 @@
+package main
+
+import (
+	"CSC445_Assignment2/tftp"
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lossyRelay stands between a client and a server on the loopback interface
+// and drops datagrams in both directions at random, and a burst of the
+// client's datagrams to the session.  The client sends its requests to
+// the relay's listening port and the relay answers from a port of its own,
+// like a server session does, so the client locks onto the relay as the
+// transfer ID.
+type lossyRelay struct {
+	listen  *net.UDPConn // Takes the client's requests
+	session *net.UDPConn // Carries the rest of the transfer to and from the client
+	back    *net.UDPConn // Talks to the server
+	server  *net.UDPAddr // Listening port of the server
+	strip   []string     // Options removed from requests
+	drop    float64      // Chance a datagram is dropped
+	burst   [2]int       // Datagrams from the client to the session dropped, counted from 0, end exclusive
+
+	mu       sync.Mutex
+	rand     *rand.Rand
+	dropped  int          // Datagrams dropped so far
+	upstream int          // Datagrams the client sent to the session so far
+	client   *net.UDPAddr // Where the client sends from
+	serverID *net.UDPAddr // Port of the server session
+}
+
+// newLossyRelay starts a relay to server that loses datagrams and rewrites
+// requests as tc asks, seeded so a failure can be reproduced
+func newLossyRelay(t *testing.T, server *net.UDPAddr, tc lossyCase, seed int64) *lossyRelay {
+	t.Helper()
+	r := &lossyRelay{server: server, strip: tc.strip, drop: tc.drop, burst: tc.burst, rand: rand.New(rand.NewSource(seed))}
+	for _, conn := range []**net.UDPConn{&r.listen, &r.session, &r.back} {
+		c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		*conn = c
+		t.Cleanup(func() { c.Close() })
+	}
+	go r.pump(r.listen, r.toServer)
+	go r.pump(r.session, r.toSession)
+	go r.pump(r.back, r.toClient)
+	return r
+}
+
+// addr returns the address clients send their requests to
+func (r *lossyRelay) addr() string {
+	return r.listen.LocalAddr().String()
+}
+
+// pump reads datagrams from conn and hands them to forward until conn is
+// closed
+func (r *lossyRelay) pump(conn *net.UDPConn, forward func(packet []byte, from *net.UDPAddr)) {
+	buf := make([]byte, maxDatagram)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		forward(append([]byte(nil), buf[:n]...), from)
+	}
+}
+
+// lose reports whether the next datagram is dropped
+func (r *lossyRelay) lose() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.rand.Float64() >= r.drop {
+		return false
+	}
+	r.dropped++
+	return true
+}
+
+// toServer forwards a request to the listening port of the server
+func (r *lossyRelay) toServer(packet []byte, from *net.UDPAddr) {
+	r.mu.Lock()
+	r.client = from
+	r.mu.Unlock()
+	if r.lose() {
+		return
+	}
+	r.back.WriteToUDP(r.stripOptions(packet), r.server)
+}
+
+// toSession forwards the client's side of a transfer to the server session
+func (r *lossyRelay) toSession(packet []byte, from *net.UDPAddr) {
+	r.mu.Lock()
+	to, n := r.serverID, r.upstream
+	r.upstream++
+	inBurst := n >= r.burst[0] && n < r.burst[1]
+	if inBurst {
+		r.dropped++
+	}
+	r.mu.Unlock()
+	if to == nil || inBurst || r.lose() {
+		return
+	}
+	r.back.WriteToUDP(packet, to)
+}
+
+// toClient forwards the server's answers to the client, from the listening
+// port what the server's listening port sent and from the session port
+// what its session sent
+func (r *lossyRelay) toClient(packet []byte, from *net.UDPAddr) {
+	r.mu.Lock()
+	client := r.client
+	via := r.listen
+	if from.Port != r.server.Port {
+		r.serverID, via = from, r.session
+	}
+	r.mu.Unlock()
+	if client == nil || r.lose() {
+		return
+	}
+	via.WriteToUDP(packet, client)
+}
+
+// stripOptions removes the relay's options from a request and passes
+// anything else through
+func (r *lossyRelay) stripOptions(packet []byte) []byte {
+	if len(r.strip) == 0 || len(packet) < 2 {
+		return packet
+	}
+	op := tftp.TFTPOpcode(binary.BigEndian.Uint16(packet))
+	if op != tftp.TFTPOpcodeRRQ && op != tftp.TFTPOpcodeWRQ {
+		return packet
+	}
+	decoded, err := tftp.Decode(packet)
+	if err != nil {
+		return packet
+	}
+	req := decoded.(*tftp.Request)
+	for _, name := range r.strip {
+		delete(req.Options, name)
+	}
+	stripped, err := req.ToBytes()
+	if err != nil {
+		return packet
+	}
+	return stripped
+}
+
+// losses returns how many datagrams the relay dropped
+func (r *lossyRelay) losses() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.dropped
+}
+
+// lossyCase is a transfer run through a lossy relay
+type lossyCase struct {
+	name      string
+	selective bool     // Ask for Selective Repeat
+	strip     []string // Options the relay removes from requests
+	window    int
+	block     int
+	size      int
+	drop      float64 // Chance a datagram is dropped
+	burst     [2]int  // Datagrams from the client to the session dropped in a row
+}
+
+// startServer runs a server on a loopback port with the current settings,
+// serving files from source and storing uploads in a temporary directory
+func startServer(t *testing.T, source Source) *TFTPProtocol {
+	t.Helper()
+	Listen, Port, UploadDir = "127.0.0.1", 0, t.TempDir()
+	srv, err := NewTFTPServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.raddr = srv.conn.LocalAddr().(*net.UDPAddr)
+	srv.settings.Load().source = source
+	go srv.handleConnectionsUDP2()
+	t.Cleanup(func() { srv.Shutdown(time.Second) })
+	return srv
+}
+
+// useSettings runs a test with the default settings changed by change and
+// puts the settings back afterwards
+func useSettings(t *testing.T, change func(s *Settings)) {
+	saved := currentSettings()
+	t.Cleanup(func() { saved.apply() })
+	s := defaultSettings()
+	change(&s)
+	s.apply()
+}
+
+// awaitSessions waits until the server's sessions ended and reports how
+// many completed and failed
+func awaitSessions(t *testing.T, m *SessionManager, want int) (completed, failed int) {
+	t.Helper()
+	deadline := time.Now().Add(15 * time.Second)
+	for {
+		m.mu.Lock()
+		completed, failed, aborted := m.completed, m.failed, m.aborted
+		m.mu.Unlock()
+		if completed+failed+aborted >= want || time.Now().After(deadline) {
+			return completed, failed + aborted
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// lossyCases are the ARQ modes run through the relay
+var lossyCases = []lossyCase{
+	{name: "StopAndWait", window: 1, block: 512, size: 40000, drop: 0.05},
+	{name: "GoBackN", window: 8, block: 512, size: 150000, drop: 0.05},
+	{name: "SelectiveRepeat", selective: true, strip: []string{"sack"}, window: 8, block: 512, size: 150000, drop: 0.05},
+	{name: "SelectiveRepeatSack", selective: true, window: 16, block: 512, size: 150000, drop: 0.05},
+	{name: "ExactBlocks", selective: true, window: 4, block: 1000, size: 50000, drop: 0.05},
+	{name: "GoBackNBurst", window: 8, block: 512, size: 60000, burst: [2]int{20, 28}},
+	{name: "SelectiveRepeatBurst", selective: true, strip: []string{"sack"}, window: 8, block: 512, size: 60000, burst: [2]int{20, 28}},
+	{name: "SelectiveRepeatSackBurst", selective: true, window: 8, block: 512, size: 60000, burst: [2]int{20, 28}},
+}
+
+// TestLossyDownload fetches files through a relay that drops datagrams and
+// checks the client got the file and the server saw the session complete
+func TestLossyDownload(t *testing.T) {
+	for i, tc := range lossyCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			payload := make([]byte, tc.size)
+			rand.New(rand.NewSource(int64(i))).Read(payload)
+			useSettings(t, func(s *Settings) {
+				s.WindowSize, s.BlockSize, s.SelectiveRepeat = tc.window, tc.block, tc.selective
+			})
+			source := NewMemSource()
+			source.Add("file", payload, "")
+			srv := startServer(t, source)
+			relay := newLossyRelay(t, srv.raddr, tc, int64(i))
+			Address = relay.addr()
+
+			c, err := NewTFTPClient()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			data, _, err := c.RequestFile("file")
+			if err != nil {
+				t.Fatalf("download failed after %d losses: %v", relay.losses(), err)
+			}
+			if !bytes.Equal(data, payload) {
+				t.Fatalf("downloaded %d bytes, want %d", len(data), len(payload))
+			}
+			if c.selective != tc.selective || c.sack != (tc.selective && len(tc.strip) == 0) {
+				t.Errorf("negotiated selective %v sack %v", c.selective, c.sack)
+			}
+			checkRTT(t, c.rtt.stats())
+			if completed, failed := awaitSessions(t, srv.sessions, 1); completed != 1 || failed != 0 {
+				t.Errorf("server sessions: %d completed, %d failed", completed, failed)
+			}
+			t.Logf("%d losses, client %s", relay.losses(), c.rtt.stats())
+		})
+	}
+}
+
+// TestLossyUpload sends files through a relay that drops datagrams and
+// checks the client finished, the server stored the file and saw the
+// session complete
+func TestLossyUpload(t *testing.T) {
+	for i, tc := range lossyCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			payload := make([]byte, tc.size)
+			rand.New(rand.NewSource(int64(i))).Read(payload)
+			useSettings(t, func(s *Settings) {
+				s.WindowSize, s.BlockSize, s.SelectiveRepeat = tc.window, tc.block, tc.selective
+			})
+			srv := startServer(t, NewMemSource())
+			relay := newLossyRelay(t, srv.raddr, tc, int64(i))
+			Address = relay.addr()
+
+			c, err := NewTFTPClient()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			if err = c.UploadFile("upload", payload); err != nil {
+				t.Fatalf("upload failed after %d losses: %v", relay.losses(), err)
+			}
+			stored, err := os.ReadFile(filepath.Join(UploadDir, "upload"))
+			if err != nil || !bytes.Equal(stored, payload) {
+				t.Fatalf("stored %d bytes, want %d: %v", len(stored), len(payload), err)
+			}
+			checkRTT(t, c.rtt.stats())
+			checkCongestion(t, c.cwnd.stats(), tc.window)
+			if completed, failed := awaitSessions(t, srv.sessions, 1); completed != 1 || failed != 0 {
+				t.Errorf("server sessions: %d completed, %d failed", completed, failed)
+			}
+			t.Logf("%d losses, client %s, %s", relay.losses(), c.rtt.stats(), c.cwnd.stats())
+		})
+	}
+}
+
+// TestRollover sends enough small blocks through a lossy relay for the
+// block number to wrap in both directions
+func TestRollover(t *testing.T) {
+	if testing.Short() {
+		t.Skip("sends over 65536 blocks each way")
+	}
+	const block = 8
+	payload := make([]byte, block*(tftp.MaxBlocks+100))
+	rand.New(rand.NewSource(1)).Read(payload)
+	useSettings(t, func(s *Settings) {
+		s.WindowSize, s.BlockSize, s.SelectiveRepeat = 32, block, true
+	})
+	source := NewMemSource()
+	source.Add("file", payload, "")
+	srv := startServer(t, source)
+	relay := newLossyRelay(t, srv.raddr, lossyCase{drop: 0.001}, 1)
+	Address = relay.addr()
+
+	c, err := NewTFTPClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _, err := c.RequestFile("file")
+	c.Close()
+	if err != nil || !bytes.Equal(data, payload) {
+		t.Fatalf("downloaded %d bytes, want %d: %v", len(data), len(payload), err)
+	}
+
+	c, err = NewTFTPClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.UploadFile("upload", payload)
+	c.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored, err := os.ReadFile(filepath.Join(UploadDir, "upload")); err != nil || !bytes.Equal(stored, payload) {
+		t.Fatalf("stored %d bytes, want %d: %v", len(stored), len(payload), err)
+	}
+	if completed, failed := awaitSessions(t, srv.sessions, 2); completed != 2 || failed != 0 {
+		t.Errorf("server sessions: %d completed, %d failed", completed, failed)
+	}
+}
+
+// checkRTT checks a session measured round trips and kept its timeout in
+// bounds
+func checkRTT(t *testing.T, s RTTStats) {
+	t.Helper()
+	if s.Samples == 0 {
+		t.Errorf("no round trips measured: %s", s)
+	}
+	if s.RTO < minRTO || s.RTO > maxRetransmitDelay || s.Min > s.Max {
+		t.Errorf("round trip statistics out of bounds: %s", s)
+	}
+}
+
+// checkCongestion checks a sending session kept its congestion window
+// within the negotiated windowsize
+func checkCongestion(t *testing.T, s CongestionStats, window int) {
+	t.Helper()
+	if s.Limit != window || s.Window < 1 || s.Window > float64(window) || s.Peak > window || s.Peak < 1 {
+		t.Errorf("congestion window out of bounds for windowsize %d: %s", window, s)
+	}
+	if window > initialWindow && s.Peak <= initialWindow {
+		t.Errorf("congestion window never opened: %s", s)
+	}
+}
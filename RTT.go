@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// minRTO is the lowest the retransmission timeout adapts down to.  RFC 6298
+// asks for a second, which is an eternity on a LAN, so like most TCP stacks
+// we allow less.
+const minRTO = 200 * time.Millisecond
+
+// RTTStats are the round trip time statistics of a session
+type RTTStats struct {
+	SRTT        time.Duration // Smoothed round trip time
+	RTTVar      time.Duration // Round trip time variation
+	RTO         time.Duration // Retransmission timeout in use
+	Min, Max    time.Duration // Shortest and longest round trip measured
+	Samples     int           // Round trips measured
+	Retransmits int           // Timeouts that sent packets again
+}
+
+// String formats the statistics for the log
+func (s RTTStats) String() string {
+	if s.Samples == 0 {
+		return fmt.Sprintf("no samples, rto %s, %d retransmits", s.RTO, s.Retransmits)
+	}
+	return fmt.Sprintf("srtt %s, rttvar %s, rto %s, min %s, max %s, %d samples, %d retransmits",
+		s.SRTT.Round(time.Microsecond), s.RTTVar.Round(time.Microsecond), s.RTO.Round(time.Microsecond),
+		s.Min.Round(time.Microsecond), s.Max.Round(time.Microsecond), s.Samples, s.Retransmits)
+}
+
+// rttEstimator estimates the round trip time to the peer and derives the
+// retransmission timeout from it as RFC 6298 does.  Callers follow Karn's
+// rule and only sample packets that were not sent again.  The transfer loop
+// updates it, the session manager reads it from other goroutines.
+type rttEstimator struct {
+	mu sync.Mutex
+	RTTStats
+}
+
+// reset starts over with no samples and initial as the timeout
+func (e *rttEstimator) reset(initial time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.RTTStats = RTTStats{RTO: clampRTO(initial)}
+}
+
+// sample adds a measured round trip time, RFC 6298 section 2
+func (e *rttEstimator) sample(rtt time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.Samples == 0 {
+		e.SRTT, e.RTTVar = rtt, rtt/2
+		e.Min, e.Max = rtt, rtt
+	} else {
+		diff := e.SRTT - rtt
+		if diff < 0 {
+			diff = -diff
+		}
+		e.RTTVar = (3*e.RTTVar + diff) / 4
+		e.SRTT = (7*e.SRTT + rtt) / 8
+		if rtt < e.Min {
+			e.Min = rtt
+		}
+		if rtt > e.Max {
+			e.Max = rtt
+		}
+	}
+	e.Samples++
+	e.RTO = clampRTO(e.SRTT + 4*e.RTTVar)
+}
+
+// backoff doubles the timeout after it expired, RFC 6298 section 5.5.  The
+// timeout stays backed off until the next sample.
+func (e *rttEstimator) backoff() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.Retransmits++
+	e.RTO = clampRTO(2 * e.RTO)
+}
+
+// timeout returns the retransmission timeout
+func (e *rttEstimator) timeout() time.Duration {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.RTO
+}
+
+// stats returns a snapshot of the statistics
+func (e *rttEstimator) stats() RTTStats {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.RTTStats
+}
+
+// clampRTO keeps a retransmission timeout between minRTO and
+// maxRetransmitDelay
+func clampRTO(rto time.Duration) time.Duration {
+	switch {
+	case rto < minRTO:
+		return minRTO
+	case rto > maxRetransmitDelay:
+		return maxRetransmitDelay
+	}
+	return rto
+}
+
+// ackProbe is an ACK a receiver sent and times the round trip of
+type ackProbe struct {
+	at    time.Time // When the ACK was sent, zero with no probe running
+	block uint64    // Block the ACK acknowledged
+}
+
+// markAck starts timing a round trip with the ACK for block n, unless one
+// is timed already.  The receiver can not tell which block the sender
+// answers the ACK with, the congestion window decides that, so it times
+// the first new block that arrives after it.
+func (c *TFTPProtocol) markAck(n uint64) {
+	if c.probe.at.IsZero() {
+		c.probe = ackProbe{at: time.Now(), block: n}
+	}
+}
+
+// sampleArrival ends the round trip timed when block n arrives in order for
+// the first time past the block the timed ACK acknowledged
+func (c *TFTPProtocol) sampleArrival(n uint64) {
+	if c.probe.at.IsZero() || n <= c.probe.block {
+		return
+	}
+	c.rtt.sample(time.Since(c.probe.at))
+	c.probe = ackProbe{}
+}
+
+// forgetAcks stops the round trip timed once a block was lost, reordered
+// or sent again, the next arrivals could be retransmissions and would time
+// the wrong round trip (Karn's rule)
+func (c *TFTPProtocol) forgetAcks() {
+	c.probe = ackProbe{}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// limiterSweep is how often client buckets that filled up again are dropped,
+// so spoofed source addresses can not grow the client table without bound
+const limiterSweep = time.Minute
+
+// tokenBucket allows events at rate per second with bursts of up to burst
+type tokenBucket struct {
+	rate   float64   // Tokens added per second
+	burst  float64   // Most tokens the bucket holds
+	tokens float64   // Tokens available, negative while sends are reserved ahead
+	last   time.Time // When tokens was last brought up to date
+}
+
+// newTokenBucket creates a full bucket, or returns nil for a rate of 0
+func newTokenBucket(rate, burst float64, now time.Time) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: now}
+}
+
+// refill adds the tokens earned since the last update
+func (b *tokenBucket) refill(now time.Time) {
+	if b == nil {
+		return
+	}
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// has reports whether n tokens are available, a nil bucket always has them
+func (b *tokenBucket) has(n float64) bool {
+	return b == nil || b.tokens >= n
+}
+
+// reserve takes n tokens, going into debt if there are not enough, and
+// returns how long the caller has to wait until the debt is paid off
+func (b *tokenBucket) reserve(n float64) time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// full reports whether the bucket has refilled completely
+func (b *tokenBucket) full() bool {
+	return b == nil || b.tokens >= b.burst
+}
+
+// clientBuckets are the buckets of one client address
+type clientBuckets struct {
+	requests *tokenBucket
+	bytes    *tokenBucket
+}
+
+// RateLimiter limits new requests and bytes sent with token buckets, across
+// all clients and per client address.  A rate of 0 means no limit.  Bursts
+// are one second worth of the rate, at least one request and one datagram.
+type RateLimiter struct {
+	requestRate, clientRequestRate float64 // Requests per second
+	byteRate, clientByteRate       float64 // Bytes per second
+
+	mu        sync.Mutex
+	requests  *tokenBucket // Requests of all clients
+	bytes     *tokenBucket // Bytes sent to all clients
+	clients   map[netip.Addr]*clientBuckets
+	lastSweep time.Time
+}
+
+// NewRateLimiter creates a rate limiter, or returns nil when every rate is
+// 0 and there is nothing to limit
+func NewRateLimiter(requestRate, clientRequestRate, byteRate, clientByteRate float64) *RateLimiter {
+	if requestRate <= 0 && clientRequestRate <= 0 && byteRate <= 0 && clientByteRate <= 0 {
+		return nil
+	}
+	now := time.Now()
+	return &RateLimiter{
+		requestRate:       requestRate,
+		clientRequestRate: clientRequestRate,
+		byteRate:          byteRate,
+		clientByteRate:    clientByteRate,
+		requests:          newTokenBucket(requestRate, requestBurst(requestRate), now),
+		bytes:             newTokenBucket(byteRate, byteBurst(byteRate), now),
+		clients:           make(map[netip.Addr]*clientBuckets),
+		lastSweep:         now,
+	}
+}
+
+// requestBurst is the burst allowed for a request rate
+func requestBurst(rate float64) float64 {
+	if rate < 1 {
+		return 1
+	}
+	return rate
+}
+
+// byteBurst is the burst allowed for a byte rate
+func byteBurst(rate float64) float64 {
+	if rate < maxDatagram {
+		return maxDatagram
+	}
+	return rate
+}
+
+// client returns the buckets of a client address, creating them on first
+// use, and drops the buckets of clients that have gone quiet
+func (l *RateLimiter) client(addr netip.Addr, now time.Time) *clientBuckets {
+	if now.Sub(l.lastSweep) > limiterSweep {
+		for a, b := range l.clients {
+			b.requests.refill(now)
+			b.bytes.refill(now)
+			if b.requests.full() && b.bytes.full() {
+				delete(l.clients, a)
+			}
+		}
+		l.lastSweep = now
+	}
+	b, ok := l.clients[addr]
+	if !ok {
+		b = &clientBuckets{
+			requests: newTokenBucket(l.clientRequestRate, requestBurst(l.clientRequestRate), now),
+			bytes:    newTokenBucket(l.clientByteRate, byteBurst(l.clientByteRate), now),
+		}
+		l.clients[addr] = b
+	}
+	return b
+}
+
+// AllowRequest reports whether a new request from addr is within the
+// request rate limits and counts it if it is
+func (l *RateLimiter) AllowRequest(addr netip.Addr) bool {
+	if l == nil {
+		return true
+	}
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	client := l.client(addr.Unmap(), now)
+	l.requests.refill(now)
+	client.requests.refill(now)
+	if !l.requests.has(1) || !client.requests.has(1) {
+		return false
+	}
+	l.requests.reserve(1)
+	client.requests.reserve(1)
+	return true
+}
+
+// ReserveBytes counts n bytes about to be sent to addr against the byte
+// rate limits and returns how long the sender has to wait before sending
+// them
+func (l *RateLimiter) ReserveBytes(addr netip.Addr, n int) time.Duration {
+	if l == nil {
+		return 0
+	}
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	client := l.client(addr.Unmap(), now)
+	l.bytes.refill(now)
+	client.bytes.refill(now)
+	wait := l.bytes.reserve(float64(n))
+	if w := client.bytes.reserve(float64(n)); w > wait {
+		wait = w
+	}
+	return wait
+}
+
+// ServerStats counts what a server did with the requests it received.  The
+// counters are shared by the listener and its sessions.
+type ServerStats struct {
+	Requests    atomic.Int64 // Requests received
+	Denied      atomic.Int64 // Requests refused by the ACL
+	Challenged  atomic.Int64 // Requests answered with a cookie instead of a session
+	Replayed    atomic.Int64 // Retransmitted requests answered by the session they already have
+	RateLimited atomic.Int64 // Requests refused by the request rate limits
+	BytesSent   atomic.Int64 // Datagram bytes of file data sent by sessions
+	Throttled   atomic.Int64 // Datagrams held back by the byte rate limits
+}
+
+// String formats the counters for the log
+func (s *ServerStats) String() string {
+	return fmt.Sprintf("%d requests, %d denied, %d challenged, %d replayed, %d rate limited, %d bytes sent, %d sends throttled",
+		s.Requests.Load(), s.Denied.Load(), s.Challenged.Load(), s.Replayed.Load(), s.RateLimited.Load(), s.BytesSent.Load(), s.Throttled.Load())
+}
+
+// pace counts n bytes of file data about to be sent to the peer and waits
+// until the byte rate limits allow them.  Only server sessions are limited,
+// the wait ends early when the session is aborted.
+func (c *TFTPProtocol) pace(n int) {
+	if c.stats == nil {
+		return
+	}
+	c.stats.BytesSent.Add(int64(n))
+	wait := c.settings.Load().limiter.ReserveBytes(c.peer.Addr(), n)
+	if wait <= 0 {
+		return
+	}
+	c.stats.Throttled.Add(1)
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-c.ctx.Done():
+	}
+}
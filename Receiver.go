@@ -4,50 +4,111 @@ import (
 	"CSC445_Assignment2/tftp"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"log"
 	"net"
+	"time"
 )
 
-// TftpClientTransferLoop is the main loop for the client side of the transfer
-func (c *TFTPProtocol) TftpClientTransferLoop(cn *net.UDPConn) (err error, finish bool) {
-	conn := *cn
+// maxPrealloc caps how much of an announced tsize is allocated up front, so
+// a bogus size can not make the client reserve gigabytes
+const maxPrealloc = 64 << 20
+
+// receiver is the main loop for the receiving side of a transfer, the client
+// of a RRQ or the server of a WRQ.  sendAck0 is set when the transfer starts
+// with us acknowledging block 0 rather than the server sending an OACK.
+// Every packet is read, decrypted and decoded in the session's pooled
+// buffers, so the loop does not allocate per packet.  The last block is left
+// unacknowledged, the caller acknowledges it once it is done with the file.
+func (c *TFTPProtocol) receiver(sendAck0 bool) (err error, finish bool) {
 	log.Printf("Starting Receiver TFTP Transfer Loop\n")
-	c.receivedPackets = make(map[uint16]*tftp.Data)
-	dataPacket := make([]byte, 1024)
+	c.acquireBuffers()
+	defer c.releaseBuffers()
+	c.decoder.Plain = c.plain // Stock clients send DATA without a checksum
+	prealloc := c.xferSize
+	if prealloc > maxPrealloc {
+		prealloc = maxPrealloc
+	}
+	c.received = make([]byte, 0, prealloc)
 	err = error(nil) // Placeholder to avoid shadowing
 	lb := false      // Last data block received
 	c.nextSeqNum = 0 // Setting to 0 for first data packet
-	ack := tftp.NewAck(c.nextSeqNum)
-	log.Printf("Sending initial ACK packet: %v\n", ack)
-	c.nextSeqNum++ // increment for first data packet
-	dataPacket = ack.ToBytes()
-	_, err = conn.Write(dataPacket)
-	if err != nil {
-		c.sendAbort()
-		return errors.New("error sending initial ACK packet: " + err.Error()), false
+	c.nextSeqNum++   // increment for first data packet
+	c.ahead = nil
+	if c.selective {
+		c.ahead = make(map[uint64][]byte, c.windowSize)
+	}
+	c.rtt.reset(c.timeout)
+	c.forgetAcks()
+	defer c.conn.SetReadDeadline(time.Time{})
+	budget, retries := c.retryBudget(), 0 // ACKs repeated while the peer is quiet
+	started := false                      // Whether any DATA arrived yet
+	if sendAck0 {
+		log.Printf("Sending initial ACK packet: %v\n", tftp.NewAck(0))
+		if err = c.sendInitialAck(); err != nil {
+			c.sendAbort()
+			return errors.New("error sending initial ACK packet: " + err.Error()), false
+		}
 	}
 	// Loop until packet received
 	for {
-		dataPacket = make([]byte, 1024) // Allocate new data packet
-		n, err := conn.Read(dataPacket) // Read data packet
-		// Decrypt data packet
-		dataPacket, _ = decrypt(dataPacket[:n], c.dhke.aes512Key)
-
-		// Get the opcode from the packet
-		opcode := binary.BigEndian.Uint16(dataPacket[:2])
+		c.conn.SetReadDeadline(time.Now().Add(c.rtt.timeout()))
+		n, err := c.readPacket((*c.readBuf)[:c.maxPacketSize()]) // Read data packet from the servers transfer ID
+		if t := c.aborted(); t != nil {
+			return c.terminate(t.Reason), false // Abort woke the read up, tear the session down
+		}
+		var nErr net.Error
+		if errors.As(err, &nErr) && nErr.Timeout() {
+			if retries++; retries > budget {
+				return fmt.Errorf("no data after repeating ACK %d %d times", c.nextSeqNum-1, budget), false
+			}
+			c.rtt.backoff()
+			switch {
+			case !started && sendAck0:
+				c.sendInitialAck() // Lost, or the OACK it answers was, and it stays in the clear
+			case !started && c.oack.Load() != nil:
+				c.replayOack() // Our OACK to a WRQ may have been lost
+			case c.sack:
+				c.sendSack() // Our last SACK may have been lost, repeat it
+			default:
+				c.sendAck(c.nextSeqNum - 1) // Our last ACK may have been lost, repeat it
+			}
+			c.forgetAcks()
+			continue
+		}
+		if err != nil {
+			return errors.New("error reading packet: " + err.Error()), false
+		}
+		// Decrypt and decode the packet, the server sends ERROR packets in the
+		// clear and anything malformed is treated as a lost packet
+		packet, dErr := c.decodeSession((*c.readBuf)[:n])
+		if dErr != nil && sendAck0 && !started && isOack((*c.readBuf)[:n]) {
+			log.Printf("OACK received again, resending initial ACK\n")
+			c.sendInitialAck() // The server did not get our ACK 0
+			continue
+		}
+		if dErr != nil {
+			log.Printf("Error decoding packet: %s\n", dErr)
+			continue
+		}
 
-		// Handle packet based on opcode
-		switch tftp.TFTPOpcode(opcode) {
-		case tftp.TFTPOpcodeERROR:
-			c.handleErrPacket(dataPacket)
-		case tftp.TFTPOpcodeTERM:
-			return errors.New("termination packet received"), false
-		case tftp.TFTPOpcodeDATA:
-			lb = c.receiveDataPacket(dataPacket) // Handle data packet
-		default:
-			if err != nil {
-				return errors.New("error reading packet: " + err.Error()), false
+		// Handle packet based on its type
+		switch p := packet.(type) {
+		case *tftp.Error:
+			return tftp.NewErr(p.ErrorCode, append([]byte(nil), p.ErrorMessage...)), false // Copy it out of the reused buffers
+		case *tftp.Term:
+			if p.Ack {
+				continue // Late acknowledgement of a TERM we no longer wait for
+			}
+			return c.acknowledgeTerm(p), false
+		case *tftp.Data:
+			c.oack.Store(nil) // The peer has the OACK, a resent request is stale
+			started, retries = true, 0
+			if c.quota > 0 && int64(len(c.received)+len(p.Data)) > c.quota {
+				c.sendError(tftp.CodeDiskFull, "Upload exceeds the size limit")
+				return tftp.ErrDiskFull, false
 			}
+			lb = c.receiveDataPacket(p) // Handle data packet
 		}
 		// If last data block received, end transfer
 		if lb {
@@ -59,30 +120,162 @@ func (c *TFTPProtocol) TftpClientTransferLoop(cn *net.UDPConn) (err error, finis
 
 // ReceiveDataPacket handles a data packet and returns true if the last data
 // note that this function needs a key to decrypt the data
-func (c *TFTPProtocol) receiveDataPacket(dataPacket []byte) bool {
-	var dataPack tftp.Data
-	err := dataPack.Parse(dataPacket, nil)
-	if err != nil || dataPack.BlockNumber != c.nextSeqNum {
+func (c *TFTPProtocol) receiveDataPacket(dataPack *tftp.Data) bool {
+	if c.selective {
+		return c.receiveSelective(dataPack)
+	}
+	block := tftp.AbsoluteBlock(dataPack.BlockNumber, c.nextSeqNum, c.rollover) // Unwrap the block number
+	if block != c.nextSeqNum {
 		// Duplicate packet or out of order packet
 		c.sendAck(c.nextSeqNum - 1) // Send ACK for previous packet
+		c.forgetAcks()
 		return false
 	}
 	if dataPack.Checksum != tftp.Checksum(dataPack.Data) {
 		c.sendAck(c.nextSeqNum - 1) // Send ACK for previous packet
+		c.forgetAcks()
 		return false
 	}
+	c.sampleArrival(block)
 	// Append data to file
-	if !c.appendFileDate(&dataPack) { // Append data to file, if duplicate packet, return false
+	if !c.appendFileDate(block, dataPack) { // Append data to file, if duplicate packet, return false
 		return false
 	}
+	c.progress.Add(int64(len(dataPack.Data)))
 	// Send ACK for this packet on routine
-	if len(dataPack.Data) < 512 {
+	if len(dataPack.Data) < int(c.blockSize) {
 		// Last data block received, end of file
 		log.Printf("Last data block received, end of file\n")
-		c.sendAck(dataPack.BlockNumber)
-		return true
+		return true // Acknowledged by the caller once the file is dealt with
 	}
 	c.sendAck(c.nextSeqNum) // Send ACK for this packet
 	c.nextSeqNum++          // Increment for next packet
 	return false            // Not last data block
 }
+
+// sendInitialAck sends ACK 0 in answer to the servers OACK.  The server
+// reads it before it has a use for the session key, so it goes out in the
+// clear like the OACK it answers.
+func (c *TFTPProtocol) sendInitialAck() error {
+	c.ack.BlockNumber = 0
+	packet, _ := c.ack.AppendTo((*c.writeBuf)[:0])
+	if _, err := c.writePacket(packet); err != nil {
+		return err
+	}
+	c.markAck(0)
+	return nil
+}
+
+// isOack reports whether a datagram is a plaintext OACK
+func isOack(packet []byte) bool {
+	return len(packet) >= 2 && tftp.TFTPOpcode(binary.BigEndian.Uint16(packet)) == tftp.TFTPOpcodeOACK
+}
+
+// ackLastBlock acknowledges the last block once the receiver is done with
+// the file, which ends the transfer for the sender
+func (c *TFTPProtocol) ackLastBlock() {
+	c.acquireBuffers()
+	defer c.releaseBuffers()
+	c.sendAck(c.nextSeqNum)
+}
+
+// handleWRQ is the entry point for the receiver side of the TFTP protocol
+// when a WRQ is received.  The upload is checked against the storage and
+// the size limit before anything is negotiated, then the server answers
+// with an OACK, or ACK 0 for a stock client that asked for no options, and
+// receives the file.  The file is committed to storage only once the last
+// block arrived and the size matches the announced tsize, and the last block
+// is only acknowledged after the commit, so the client learns whether the
+// file was stored.
+func (c *TFTPProtocol) handleWRQ(addr *net.UDPAddr, req *tftp.Request) {
+	defer c.releaseSession() // Nothing of the session outlives the request
+	if !c.checkRequest(addr, req) {
+		return
+	}
+	name := string(req.Filename)
+	storage := c.settings.Load().storage
+	if err := storage.Check(name); err != nil {
+		c.sendErrorClient(tftp.CodeAccessViolation, "Upload refused: "+err.Error(), addr)
+		return
+	}
+	size, sized := req.Options.Uint("tsize")
+	c.quota = c.settings.Load().maxUploadSize
+	if c.quota > 0 && sized && size > uint64(c.quota) {
+		c.sendErrorClient(tftp.CodeDiskFull, fmt.Sprintf("Upload of %d bytes exceeds the limit of %d bytes", size, c.quota), addr)
+		return
+	}
+	if !c.keyExchange(addr, req) {
+		return
+	}
+	oack := c.SetProtocolOptions(req.Options, int(size)) //Negotiate the protocol options
+	if sized {
+		oack.XferSize = c.xferSize // Accept the announced size
+	}
+	if sized && !c.rolloverOK && size/uint64(c.blockSize)+1 > tftp.MaxBlocks {
+		// Without rollover the block number would wrap silently
+		c.sendErrorClient(tftp.CodeDiskFull, "File too large, negotiate rollover or a larger blksize", addr)
+		return
+	}
+
+	oacked, err := c.sendOack(addr, oack)
+	if err != nil {
+		c.sendErrorClient(tftp.CodeNotDefined, "Error writing to UDP", addr)
+		return
+	}
+	c.setState(SessionTransferring)
+	if err, _ = c.receiver(!oacked); err != nil {
+		c.endTransfer(err)
+		return
+	}
+
+	data := c.rebuildData()
+	if sized && uint64(len(data)) != size {
+		log.Printf("Upload of %s ended after %d bytes, client announced %d\n", name, len(data), size)
+		c.sendError(tftp.CodeNotDefined, "Upload does not match the announced tsize")
+		return
+	}
+	if c.mode == tftp.ModeNetascii {
+		data = tftp.FromNetascii(data) // Store the file with local line endings
+	}
+	if err = storage.Commit(name, data); err != nil {
+		log.Printf("Error storing upload %s: %s\n", name, err)
+		c.sendError(tftp.CodeNotDefined, "Unable to store file")
+		return
+	}
+	log.Printf("Stored upload %s, %d bytes\n", name, len(data))
+	c.ackLastBlock()
+	c.setState(SessionCompleted)
+	c.lingerLastAck()
+}
+
+// lingerLastAck keeps the transfer ID open for a retransmission timeout
+// after the last block was acknowledged.  Should the ACK get lost the client
+// sends the last block again, and it is acknowledged again instead of
+// retrying against a closed port until it gives up on a stored file.
+func (c *TFTPProtocol) lingerLastAck() {
+	c.acquireBuffers()
+	defer c.releaseBuffers()
+	defer c.conn.SetReadDeadline(time.Time{})
+	linger := c.rtt.timeout()
+	if c.timeout > linger {
+		linger = c.timeout
+	}
+	c.conn.SetReadDeadline(time.Now().Add(linger))
+	for c.aborted() == nil {
+		n, err := c.readPacket(*c.readBuf)
+		if err != nil {
+			return // Nothing more from the client
+		}
+		packet, err := c.decodeSession((*c.readBuf)[:n])
+		if err != nil {
+			continue
+		}
+		switch packet.(type) {
+		case *tftp.Data:
+			log.Printf("Last block received again, resending its ACK\n")
+			c.sendAck(c.nextSeqNum) // Cumulative, it covers whatever block came again
+		case *tftp.Term, *tftp.Error:
+			return
+		}
+	}
+}
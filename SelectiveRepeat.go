@@ -0,0 +1,387 @@
+package main
+
+import (
+	"CSC445_Assignment2/tftp"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"time"
+)
+
+// inFlight is a block a Selective Repeat sender sent and waits on an ACK for
+type inFlight struct {
+	sent     time.Time // When the block was first sent
+	deadline time.Time // When the block is sent again
+	retries  int       // Times the block was sent again
+	acked    bool      // Acknowledged, maybe ahead of base
+}
+
+// flightWindow holds the blocks a Selective Repeat sender sent from base on
+// in a ring indexed by block number, so sending and acknowledging blocks
+// allocates nothing.  At most windowsize blocks are ever in flight, so
+// no two of them share a slot.
+type flightWindow struct {
+	slots      []inFlight
+	base, next int // Oldest unacknowledged block and next block to send
+}
+
+// newFlightWindow returns an empty window of size blocks starting at block 1
+func newFlightWindow(size uint16) *flightWindow {
+	return &flightWindow{slots: make([]inFlight, size), base: 1, next: 1}
+}
+
+// at returns the slot of a block
+func (w *flightWindow) at(block int) *inFlight {
+	return &w.slots[block%len(w.slots)]
+}
+
+// pending returns the slot of a block that was sent and is not
+// acknowledged yet, or nil
+func (w *flightWindow) pending(block int) *inFlight {
+	if block < w.base || block >= w.next {
+		return nil
+	}
+	if f := w.at(block); !f.acked {
+		return f
+	}
+	return nil
+}
+
+// send records that the next block went out at now
+func (w *flightWindow) send(now, deadline time.Time) {
+	*w.at(w.next) = inFlight{sent: now, deadline: deadline}
+	w.next++
+}
+
+// slide moves base past every block acknowledged in a row and reports
+// whether it moved
+func (w *flightWindow) slide() bool {
+	from := w.base
+	for w.base < w.next && w.at(w.base).acked {
+		w.base++
+	}
+	return w.base != from
+}
+
+// earliest returns the first deadline of the blocks in flight
+func (w *flightWindow) earliest() time.Time {
+	var first time.Time
+	for block := w.base; block < w.next; block++ {
+		if f := w.at(block); !f.acked && (first.IsZero() || f.deadline.Before(first)) {
+			first = f.deadline
+		}
+	}
+	return first
+}
+
+// selectiveRepeat keeps the congestion window from the oldest
+// unacknowledged block, base, full and runs a timer per block in flight.
+// ACKs acknowledge single blocks, only blocks whose timer expires are sent
+// again, and the window slides once base is acknowledged.  Repeated ACKs for
+// blocks past base report base lost and send it again early.  The ACK for
+// the last block is cumulative, the receiver only sends it once it has the
+// whole file.  With SACK negotiated every ACK is cumulative and SACKs list
+// the blocks that arrived past a gap, the holes between them are sent again
+// early.  ACKs for blocks sent once time the round trip.  The transfer fails
+// once a block went unacknowledged through the retry budget.
+func (c *TFTPProtocol) selectiveRepeat(ap netip.AddrPort, budget int) error {
+	last := c.blockCount() // Number of the final, short block
+	pastBase := 0          // ACKs for blocks past base since base last moved
+	c.rtt.reset(c.timeout)
+	c.cwnd.reset(c.windowSize)
+	w := newFlightWindow(c.windowSize)
+
+	for w.base <= last {
+		if t := c.aborted(); t != nil {
+			return c.terminate(t.Reason) // Cancelled or shutting down, tell the client
+		}
+		for w.next < w.base+c.cwnd.size() && w.next <= last {
+			if err := c.sendBlock(w.next, ap); err != nil {
+				return err
+			}
+			now := time.Now()
+			w.send(now, now.Add(c.rtt.timeout()))
+		}
+
+		c.conn.SetReadDeadline(w.earliest())
+		n, err := c.readPacket(*c.readBuf)
+		if t := c.aborted(); t != nil {
+			return c.terminate(t.Reason)
+		}
+		var nErr net.Error
+		if errors.As(err, &nErr) && nErr.Timeout() {
+			if err = c.resendExpired(w, ap, budget); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("error reading ACK: %w", err)
+		}
+
+		decoded, err := c.decodeSession((*c.readBuf)[:n])
+		if err != nil {
+			log.Printf("Error parsing ACK packet: %s\n", err)
+			continue
+		}
+		switch p := decoded.(type) {
+		case *tftp.Ack:
+			block := int(tftp.AbsoluteBlock(p.BlockNumber, uint64(w.base), c.rollover))
+			if c.sack || block == last {
+				for b := w.base; b <= block && b < w.next; b++ { // Cumulative
+					c.ackBlock(w, b, b == block)
+				}
+			} else {
+				if !c.ackBlock(w, block, true) {
+					continue // Acknowledged before, or never sent
+				}
+				if block != w.base {
+					if pastBase++; pastBase == dupAckLimit && c.cwnd.lost(w.base, w.next-1) {
+						if err = c.resendLost(w.base, w.at(w.base), ap, budget); err != nil {
+							return err
+						}
+					}
+					continue
+				}
+			}
+			if w.slide() {
+				pastBase = 0
+			}
+		case *tftp.Sack:
+			if !c.sack {
+				log.Printf("Received SACK without negotiating it, ignoring\n")
+				continue
+			}
+			cumulative := int(tftp.AbsoluteBlock(p.BlockNumber, uint64(w.base), c.rollover))
+			for b := w.base; b <= cumulative && b < w.next; b++ {
+				c.ackBlock(w, b, false) // The SACK answers the newest arrival, no telling which
+			}
+			for _, r := range p.Ranges {
+				start := int(tftp.AbsoluteBlock(r.Start, uint64(w.base), c.rollover))
+				end := int(tftp.AbsoluteBlock(r.End, uint64(w.base), c.rollover))
+				if start < w.base {
+					start = w.base
+				}
+				for b := start; b <= end && b < w.next; b++ {
+					c.ackBlock(w, b, false)
+				}
+			}
+			w.slide()
+			if err = c.resendHoles(w, ap, budget); err != nil {
+				return err
+			}
+		case *tftp.Term, *tftp.Error:
+			if err = c.peerEnded(p); err != nil {
+				return err
+			}
+		default:
+			log.Printf("Received unexpected %s packet, window base %d, next %d\n", decoded.Opcode(), w.base, w.next)
+		}
+	}
+
+	log.Printf("All packets sent and acknowledged\n")
+	return nil
+}
+
+// ackBlock marks a block in flight acknowledged and opens the congestion
+// window for it.  timed ACKs answer the block itself and time the round
+// trip, unless it was sent again.  It reports whether the block was in
+// flight.
+func (c *TFTPProtocol) ackBlock(w *flightWindow, block int, timed bool) bool {
+	f := w.pending(block)
+	if f == nil {
+		return false
+	}
+	if timed && f.retries == 0 {
+		c.rtt.sample(time.Since(f.sent)) // Karn's rule, a resent block could be answering either send
+	}
+	f.acked = true
+	c.cwnd.acked(1)
+	return true
+}
+
+// resendHoles sends the blocks a SACK reports missing between base and
+// next again.  A hole counts as lost once dupAckLimit blocks past it
+// arrived, before that it could still be on its way out of order.  Each
+// hole is only sent again early once, after that its timer resends it.
+func (c *TFTPProtocol) resendHoles(w *flightWindow, ap netip.AddrPort, budget int) error {
+	past := 0 // Blocks acknowledged after the one looked at
+	for block := w.next - 1; block >= w.base; block-- {
+		f := w.at(block)
+		if f.acked {
+			past++
+			continue
+		}
+		if f.retries > 0 || past < dupAckLimit {
+			continue
+		}
+		c.cwnd.lost(block, w.next-1) // Once for all holes of the same flight
+		if err := c.resendLost(block, f, ap, budget); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resendExpired sends the blocks whose timer expired again, backing the
+// timeout off and closing the congestion window, and fails once a block ran
+// through the retry budget
+func (c *TFTPProtocol) resendExpired(w *flightWindow, ap netip.AddrPort, budget int) error {
+	now := time.Now()
+	backedOff := false
+	for block := w.base; block < w.next; block++ {
+		f := w.at(block)
+		if f.acked || f.deadline.After(now) {
+			continue
+		}
+		if f.retries++; f.retries > budget {
+			log.Printf("Block %d unacknowledged after %d retransmissions, giving up\n", block, budget)
+			return fmt.Errorf("block %d unacknowledged after %d retransmissions", block, budget)
+		}
+		if !backedOff {
+			c.rtt.backoff() // Once for every expiry, however many blocks it resends
+			c.cwnd.timeout(w.next - 1)
+			backedOff = true
+		}
+		log.Printf("Timeout, resending block %d\n", block)
+		if err := c.sendBlock(block, ap); err != nil {
+			return err
+		}
+		f.deadline = now.Add(c.rtt.timeout())
+	}
+	return nil
+}
+
+// resendLost sends block, which the receiver reported lost, again without
+// waiting for its timer, and fails once it ran through the retry budget
+func (c *TFTPProtocol) resendLost(block int, f *inFlight, ap netip.AddrPort, budget int) error {
+	if f.retries++; f.retries > budget {
+		log.Printf("Block %d unacknowledged after %d retransmissions, giving up\n", block, budget)
+		return fmt.Errorf("block %d unacknowledged after %d retransmissions", block, budget)
+	}
+	log.Printf("Block %d lost, resending it\n", block)
+	if err := c.sendBlock(block, ap); err != nil {
+		return err
+	}
+	f.deadline = time.Now().Add(c.rtt.timeout())
+	return nil
+}
+
+// receiveSelective handles a DATA packet for a Selective Repeat receiver
+// and reports whether the file is complete.  Blocks ahead of the next one
+// expected are held until the gap before them is filled, and blocks already
+// delivered are acknowledged again in case the ACK got lost.  Every block is
+// acknowledged on its own, or with SACK negotiated by a cumulative ACK, or a
+// SACK while blocks are held past a gap.  The last block is only
+// acknowledged by the caller, once the file is dealt with.
+func (c *TFTPProtocol) receiveSelective(dataPack *tftp.Data) bool {
+	block := tftp.AbsoluteBlock(dataPack.BlockNumber, c.nextSeqNum, c.rollover)
+	if dataPack.Checksum != tftp.Checksum(dataPack.Data) {
+		c.forgetAcks()
+		return false // Lost, the sender times it out
+	}
+	last := len(dataPack.Data) < int(c.blockSize)
+	switch {
+	case block < c.nextSeqNum:
+		if c.sack {
+			c.sendSack() // Delivered before, our ACK got lost
+		} else {
+			c.sendAck(block)
+		}
+		c.forgetAcks()
+		return false
+	case block >= c.nextSeqNum+uint64(c.windowSize):
+		return false // Outside the window, the sender can not have sent it yet
+	case block > c.nextSeqNum:
+		if _, held := c.ahead[block]; !held {
+			c.ahead[block] = append([]byte(nil), dataPack.Data...) // Copy it out of the reused buffers
+		}
+		if c.sack {
+			c.sendSack()
+		} else if !last {
+			c.sendAck(block)
+		}
+		c.forgetAcks() // A gap, something before it was lost
+		return false
+	}
+
+	c.sampleArrival(block)
+	c.deliver(dataPack.Data)
+	for !last {
+		if !c.sack {
+			c.sendAck(c.nextSeqNum)
+		}
+		c.nextSeqNum++
+		data, held := c.ahead[c.nextSeqNum]
+		if !held {
+			if c.sack {
+				c.sendSack() // One ACK for everything delivered
+			}
+			return false
+		}
+		delete(c.ahead, c.nextSeqNum)
+		last = len(data) < int(c.blockSize)
+		c.deliver(data)
+	}
+	if c.sack && c.nextSeqNum > block {
+		c.sendAck(c.nextSeqNum - 1) // The blocks drained before the last one
+	}
+	log.Printf("Last data block received, end of file\n")
+	return true // Acknowledged by the caller once the file is dealt with
+}
+
+// sendSack acknowledges every block delivered with a cumulative ACK, or a
+// SACK that also lists the runs of blocks held past a gap.  A held last
+// block is left out, only the caller acknowledges it.
+func (c *TFTPProtocol) sendSack() {
+	held := c.sackHeld[:0]
+	for block, data := range c.ahead {
+		if len(data) == int(c.blockSize) {
+			held = append(held, block)
+		}
+	}
+	c.sackHeld = held
+	if len(held) == 0 {
+		c.sendAck(c.nextSeqNum - 1)
+		return
+	}
+	// Insertion sort, at most a window of blocks is held and unlike
+	// sort.Slice it does not allocate
+	for i := 1; i < len(held); i++ {
+		for j := i; j > 0 && held[j] < held[j-1]; j-- {
+			held[j], held[j-1] = held[j-1], held[j]
+		}
+	}
+	c.sackPack.BlockNumber = tftp.WireBlock(c.nextSeqNum-1, c.rollover)
+	c.sackPack.Ranges = c.sackPack.Ranges[:0]
+	for i := 0; i < len(held) && len(c.sackPack.Ranges) < tftp.MaxSackRanges; {
+		j := i + 1
+		for j < len(held) && held[j] == held[j-1]+1 {
+			j++
+		}
+		c.sackPack.Ranges = append(c.sackPack.Ranges, tftp.SackRange{
+			Start: tftp.WireBlock(held[i], c.rollover),
+			End:   tftp.WireBlock(held[j-1], c.rollover),
+		})
+		i = j
+	}
+	packet, err := c.sealPacket(&c.sackPack)
+	if err != nil {
+		log.Println("Error sealing SACK packet:", err)
+		return
+	}
+	n, err := c.writePacket(packet)
+	c.ADto(n)
+	if err != nil {
+		log.Println("Error sending SACK packet:", err)
+	}
+}
+
+// deliver appends the data of the next block in order to the file
+func (c *TFTPProtocol) deliver(data []byte) {
+	c.received = append(c.received, data...)
+	c.totalFrames++
+	c.progress.Add(int64(len(data)))
+}
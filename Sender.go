@@ -2,35 +2,111 @@ package main
 
 import (
 	"CSC445_Assignment2/tftp"
-	"encoding/binary"
 	"errors"
 	"fmt"
 	"hash/crc32"
 	"log"
 	"math/big"
 	"net"
+	"net/netip"
 	"time"
 )
 
 // handleRRQ is the entry point for the sender side of the TFTP protocol
-// when a RRQ is received.  It parses the request, sends an OACK, and
-// enters the sender loop.
-func (c *TFTPProtocol) handleRRQ(addr *net.UDPAddr, buf []byte) {
-	var req tftp.Request
-	err := req.Parse(buf) // Parse the request
+// when a RRQ is received.  The file is opened from the source the server
+// routes the filename to and streamed from it block by block.  It sends an
+// OACK for the decoded request and enters the sender loop.  A request
+// without key exchange options comes from a stock RFC 1350 client and is
+// served in plaintext unless policy forbids it.
+func (c *TFTPProtocol) handleRRQ(addr *net.UDPAddr, req *tftp.Request) {
+	defer c.releaseSession() // Nothing of the session outlives the request
+	if !c.checkRequest(addr, req) {
+		return
+	}
+	content, err := c.openContent(req)
+	if errors.Is(err, ErrOutsideRoot) {
+		c.sendErrorClient(tftp.CodeAccessViolation, "Access violation", addr)
+		return
+	}
+	if err != nil && c.aborted() != nil {
+		c.endTransfer(err) // Cancelled while the file was being fetched
+		return
+	}
 	if err != nil {
-		parseErr := fmt.Errorf("error parsing request: %s", err)
-		log.Printf("Error parsing request: %s\n", parseErr)
-		c.sendError(5, parseErr.Error())
+		log.Printf("Error opening %s: %s\n", req.Filename, err)
+		c.sendErrorClient(tftp.CodeFileNotFound, "File not found", addr)
+		return
+	}
+	defer content.Close()
+	c.content = content
+	if !c.keyExchange(addr, req) {
+		return
+	}
+	opAck2 := c.SetProtocolOptions(req.Options, int(content.Size())) //Negotiate the protocol options
+	if !c.rolloverOK && c.blockCount() > tftp.MaxBlocks {
+		// Without rollover the block number would wrap silently
+		c.sendErrorClient(tftp.CodeDiskFull, "File too large, negotiate rollover or a larger blksize", addr)
 		return
 	}
-	log.Printf("Received %d bytes from %s for file %s \n", len(buf), addr.String(), string(req.Filename))
-	file, err := ProxyRequest(string(req.Filename))
 
+	// RFC 1350 clients that sent no options get no OACK, the transfer
+	// starts with the first data block instead of waiting for ACK 0
+	oack, err := c.sendOack(addr, opAck2)
 	if err != nil {
-		c.sendError(5, "File not found")
+		c.sendErrorClient(tftp.CodeNotDefined, "Error writing to UDP", addr)
 		return
 	}
+
+	c.setState(SessionTransferring)
+	c.endTransfer(c.sender(addr, oack))
+}
+
+// openContent opens the file a RRQ asks for from the session's sources.
+// Netascii transfers are translated block by block as they are read, the
+// file is read through once first as the translation changes its size.
+func (c *TFTPProtocol) openContent(req *tftp.Request) (Content, error) {
+	name := string(req.Filename)
+	object, err := c.settings.Load().source.Open(c.ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Opened %s: %d bytes, type %q\n", name, object.Size(), object.ContentType)
+	if c.mode != tftp.ModeNetascii {
+		return object.Content, nil
+	}
+	content, err := newNetasciiContent(object.Content, int(c.requestedBlockSize(req.Options)))
+	if err != nil {
+		object.Close()
+		return nil, err
+	}
+	return content, nil
+}
+
+// checkRequest applies the checks every request has to pass before any work
+// is done for it, whether plaintext is allowed and whether the transfer mode
+// is supported, and answers the client when one fails
+func (c *TFTPProtocol) checkRequest(addr *net.UDPAddr, req *tftp.Request) bool {
+	c.plain = req.Options["keyx"] == nil || req.Options["keyy"] == nil
+	if c.plain && c.settings.Load().forbidPlaintext {
+		c.sendErrorClient(tftp.CodeAccessViolation, "Plaintext sessions are not allowed, key exchange required", addr)
+		return false
+	}
+	c.mode = tftp.NormalizeMode(req.Mode)
+	if c.mode != tftp.ModeOctet && c.mode != tftp.ModeNetascii {
+		c.sendErrorClient(tftp.CodeIllegalOperation, "Unsupported transfer mode "+c.mode, addr)
+		return false
+	}
+	return true
+}
+
+// keyExchange completes the key exchange the client started in its request
+// and derives the session key.  Plaintext sessions skip it.
+func (c *TFTPProtocol) keyExchange(addr *net.UDPAddr, req *tftp.Request) bool {
+	if c.plain {
+		log.Printf("No key exchange requested by %s, serving plaintext\n", addr)
+		return true
+	}
+	var err error
 	c.dhke = new(DHKESession)                                // Create a new DHKE session
 	c.dhke.GenerateKeyPair()                                 // Generate a new key pair for server
 	px, py := new(big.Int), new(big.Int)                     // Create new big ints to hold clients public keys
@@ -39,116 +115,307 @@ func (c *TFTPProtocol) handleRRQ(addr *net.UDPAddr, buf []byte) {
 	c.dhke.sharedKey, err = c.dhke.generateSharedKey(px, py) // Generate the shared key
 	if err != nil {
 		log.Printf("Error generating shared key: %v\n", err.Error())
-		c.sendErrorClient(11, "Error generating shared key", addr)
-		return
+		c.sendErrorClient(tftp.CodeKeyExchange, "Error generating shared key", addr)
+		return false
 	}
-	c.SetProtocolOptions(req.Options, 0) //Set the protocol options
 	log.Printf("Shared Key Chechksum %d\n", crc32.ChecksumIEEE(c.dhke.sharedKey))
-	// Lazy interface to new option packets
-	opAck2 := tftp.OptionAcknowledgement{
-		Opcode: tftp.TFTPOpcodeOACK,
-		KeyX:   c.dhke.pubKeyX.Bytes(),
-		KeyY:   c.dhke.pubKeyY.Bytes(),
+	return true
+}
+
+// sendOack adds our half of the key exchange to the negotiated options and
+// sends them to the client.  It reports whether an OACK was sent, clients
+// that asked for no options do not get one.
+func (c *TFTPProtocol) sendOack(addr *net.UDPAddr, oack *tftp.OptionAcknowledgement) (bool, error) {
+	log.Printf("Negotiated block size %d, window size %d, timeout %s\n", c.blockSize, c.windowSize, c.timeout)
+	if !c.plain {
+		oack.KeyX = c.dhke.pubKeyX.Bytes() // Answer with our half of the key exchange
+		oack.KeyY = c.dhke.pubKeyY.Bytes()
+	}
+	if len(oack.Options()) == 0 {
+		return false, nil
 	}
+	packet := oack.ToBytes()
+	c.oack.Store(&packet)                     // Kept for a client that resends its request
+	_, err := c.conn.WriteToUDP(packet, addr) //Send the OACK
+	return err == nil, err
+}
 
-	_, err = c.conn.WriteToUDP(opAck2.ToBytes(), addr) //Send the OACK
-	if err != nil {
-		c.sendErrorClient(6, "Error writing to UDP", addr)
+// minReplayInterval is the least time between two OACKs a session replays
+// for retransmitted requests.  Clients resend a request after a timeout of
+// a second or more, so requests arriving faster are spoofed and not
+// answered.
+const minReplayInterval = 500 * time.Millisecond
+
+// replayOack answers a retransmitted request with the OACK already sent for
+// it, so a lost OACK costs no second key exchange or fetch.  A session that
+// has not answered yet, or whose client already answered, ignores it, and so
+// does one that replayed the OACK less than minReplayInterval ago.
+func (c *TFTPProtocol) replayOack() {
+	packet := c.oack.Load()
+	if packet == nil {
 		return
 	}
-
-	c.dataBlocks, err = PrepareData(file, int(c.blockSize), c.dhke.aes512Key) //Prepare the data blocks
-	if err != nil {
-		c.sendErrorClient(5, "Error preparing data blocks", addr)
+	now, last := time.Now().UnixNano(), c.lastReplay.Load()
+	if now-last < int64(minReplayInterval) || !c.lastReplay.CompareAndSwap(last, now) {
 		return
 	}
+	log.Printf("Replaying OACK to %s\n", c.peer)
+	c.conn.WriteToUDPAddrPort(*packet, c.peer)
+}
 
-	err = c.sender(addr)
-	if err != nil {
-		log.Printf("Error sending file: %v\n", err.Error())
-		c.sendErrorClient(5, "Error sending file", addr)
-		return
+// endTransfer tears a session down after its transfer loop returned err.
+// A TERM or ERROR has already ended the session on both sides, a cancelled
+// session is terminated with the reason it was cancelled for and any other
+// error terminates it as failed.
+func (c *TFTPProtocol) endTransfer(err error) {
+	var term *tftp.Term
+	var peerErr *tftp.Error
+	switch {
+	case err == nil:
+		c.setState(SessionCompleted)
+	case errors.As(err, &term):
+		log.Printf("Transfer terminated: %s\n", term.Reason) // Both sides have already let go of the session
+	case errors.As(err, &peerErr):
+		log.Printf("Transfer failed: %s\n", peerErr) // The error ended the session on both sides
+	case c.aborted() != nil:
+		c.terminate(c.aborted().Reason) // Cancelled before the transfer got going
+	default:
+		log.Printf("Error in transfer: %v\n", err.Error())
+		c.terminate(tftp.TermError)
 	}
 }
 
-// sender is the main loop for the sender side of the TFTP protocol
-// It sends data blocks and waits for ACKs.  If an ACK is not received
-// within the timeout period, the data block is resent.  If an error
-// occurs, the error is logged and the loop is exited.
-func (c *TFTPProtocol) sender(addr *net.UDPAddr) error {
-	var ack tftp.Ack
+// sender is the sender side of the TFTP protocol.  It sends the content
+// with Go-Back-N, or Selective Repeat when the peer negotiated it, and
+// returns once every block was acknowledged.  awaitAck0 is set when an OACK
+// was sent, which the client acknowledges with block 0.
+func (c *TFTPProtocol) sender(addr *net.UDPAddr, awaitAck0 bool) error {
 	log.Println("Starting sender transfer TFTP loop")
-	packet := make([]byte, 1024)                                     //Byte slice "buffer"
-	base, nextSeqNum := 1, 1                                         //Initialize the base, next sequence number, and drop probability
-	tOuts, mDelay, iDelay := 0, 30*time.Second, 500*time.Millisecond //Initialize the timeout counter, max delay, and initial delay
-	delay := iDelay                                                  // set initial to delay to current delay value
-	n, _ := c.conn.Read(packet)                                      //Read the initial ACK
-	log.Printf("Initial ACK received: %v\n", n)
-	packet = packet[:n]      //Trim the packet to the size of the data received
-	err := ack.Parse(packet) // Parse the ACK
-	log.Printf("Initial ACK received: %v\n", ack)
-	if err != nil {
-		return errors.New("error parsing ack packet: " + err.Error())
-	}
-	if ack.BlockNumber != 0 { //Check if the block number is 0 got initial ACK
-		c.sendError(3, "Expected initial block number to be 0")
-		return errors.New("error parsing ack packet: block number should be 0, expecting initial block")
-	}
-
-	// Loop until all data blocks have been sent and acknowledged
-	// Send packets within the window size
-	for nextSeqNum < base+WindowSize && nextSeqNum <= len(c.dataBlocks) {
-		//Encrypt the packet
-		packet, _ = encrypt(c.dataBlocks[nextSeqNum-1].ToBytes(), c.dhke.aes512Key)
-		//Send the data block
-		go c.conn.WriteToUDP(packet, addr)
-		//Increment the next sequence number
-		nextSeqNum++
-		//Read the ACK
-		n, _ = c.conn.Read(packet)
-		//Decrypt the ack packet
-		packet, _ = decrypt(packet[:n], c.dhke.aes512Key)
-
-		if nErr, ok := err.(net.Error); ok && nErr.Timeout() { //Check if the error is a timeout error
-			log.Printf("Timeout, resending unacknowledged packets\n") //If it is a timeout error, log it and increment the timeout counter
-			tOuts++                                                   //Increment the timeout counter
-			delay = iDelay * (1 << tOuts)                             // 2^tOuts
-			if delay > mDelay {                                       // If the delay is greater than the max delay, set the delay to the max delay
-				delay = mDelay
+	c.acquireBuffers() // Packets are framed and read in pooled buffers
+	defer c.releaseBuffers()
+	defer c.conn.SetReadDeadline(time.Time{})
+	budget := c.retryBudget()
+	if awaitAck0 {
+		if err := c.awaitInitialAck(addr, budget); err != nil {
+			return err
+		}
+		c.oack.Store(nil) // The client has the OACK, a resent request is stale
+	}
+
+	ap := addr.AddrPort() // Send to the netip form, it does not allocate per write
+	if c.selective {
+		return c.selectiveRepeat(ap, budget)
+	}
+	return c.goBackN(ap, budget)
+}
+
+// goBackN keeps the congestion window from the oldest unacknowledged block,
+// base, full and runs one retransmission timer for base.  A cumulative ACK
+// slides the window and restarts the timer, when the timer expires, or
+// repeated ACKs for the block before base report it lost, every block from
+// base on is sent again.  ACKs for blocks sent once time the round trip
+// that sets the timeout.  The transfer fails once base went unacknowledged
+// through the retry budget.
+func (c *TFTPProtocol) goBackN(ap netip.AddrPort, budget int) error {
+	last := c.blockCount()                          // Number of the final, short block
+	base, next := 1, 1                              // Oldest unacknowledged block and next block to send
+	highest := 0                                    // Highest block sent so far, anything up to it is sent again after a timeout
+	retries := 0                                    // Consecutive expiries without progress
+	dupAcks := 0                                    // ACKs in a row for the block before base
+	var deadline time.Time                          // When base is sent again
+	sentAt := make(map[int]time.Time, c.windowSize) // When blocks in flight that were sent once went out
+	c.rtt.reset(c.timeout)
+	c.cwnd.reset(c.windowSize)
+
+	for base <= last {
+		if t := c.aborted(); t != nil {
+			return c.terminate(t.Reason) // Cancelled or shutting down, tell the client
+		}
+		// Fill the congestion window, the timer starts with the oldest block in flight
+		for next < base+c.cwnd.size() && next <= last {
+			if err := c.sendBlock(next, ap); err != nil {
+				return err
 			}
-			c.conn.SetReadDeadline(time.Now().Add(delay)) //Set the read deadline to the current time plus the delay
-			if tOuts >= 5 {
-				log.Println("Closing connection due to 5 consecutive unacknowledged packets")
-				return fmt.Errorf("connection closed after 5 consecutive unacknowledged packets")
+			now := time.Now()
+			if next > highest {
+				highest = next
+				sentAt[next] = now
 			}
-			continue // Continue to the next iteration of the loop while not incrementing the next sequence number
+			if next == base {
+				deadline = now.Add(c.rtt.timeout())
+			}
+			next++
 		}
 
-		tOuts = 0 // Reset consecutive timeouts counter when an ACK is received
+		c.conn.SetReadDeadline(deadline)
+		n, err := c.readPacket(*c.readBuf)
+		if t := c.aborted(); t != nil {
+			return c.terminate(t.Reason)
+		}
+		var nErr net.Error
+		if errors.As(err, &nErr) && nErr.Timeout() {
+			if retries++; retries > budget {
+				log.Printf("Block %d unacknowledged after %d retransmissions, giving up\n", base, budget)
+				return fmt.Errorf("block %d unacknowledged after %d retransmissions", base, budget)
+			}
+			c.rtt.backoff()
+			c.cwnd.timeout(highest)
+			log.Printf("Timeout, resending from block %d\n", base)
+			next, dupAcks = base, 0 // Go back N
+			for block := range sentAt {
+				delete(sentAt, block) // Karn's rule, an ACK could answer either send
+			}
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("error reading ACK: %w", err)
+		}
 
-		opcode := binary.BigEndian.Uint16(packet[:2]) //Get the opcode from the packet
-		switch tftp.TFTPOpcode(opcode) {
-		case tftp.TFTPOpcodeACK: //If the opcode is an ACK
-			err = ack.Parse(packet) //Parse the ACK
-			if err != nil {
-				log.Printf("Error parsing ACK packet: %s\n", err)
+		decoded, err := c.decodeSession((*c.readBuf)[:n]) //Decrypt and decode the packet
+		if err != nil {
+			log.Printf("Error parsing ACK packet: %s\n", err)
+			continue
+		}
+		switch ack := decoded.(type) {
+		case *tftp.Ack:
+			//Unwrap the block number around the base, ACKs are cumulative
+			block := int(tftp.AbsoluteBlock(ack.BlockNumber, uint64(base), c.rollover))
+			switch {
+			case block >= base && block <= highest:
+				// Past next after a timeout went back, the blocks sent
+				// before it arrived and need not go out again
+				if sent, ok := sentAt[block]; ok {
+					c.rtt.sample(time.Since(sent))
+				}
+				c.cwnd.acked(block - base + 1)
+				for ; base <= block; base++ {
+					delete(sentAt, base)
+				}
+				if next < base {
+					next = base
+				}
+				retries, dupAcks = 0, 0
+				deadline = time.Now().Add(c.rtt.timeout()) // Restart the timer for the new base
+			case block == base-1 && next > base:
+				// The receiver got a block past a gap and acknowledged the
+				// last one in order again, base was lost
+				if dupAcks++; dupAcks == dupAckLimit && c.cwnd.lost(base, highest) {
+					log.Printf("Block %d lost, resending from it\n", base)
+					next = base // Go back N without waiting for the timer
+					for block := range sentAt {
+						delete(sentAt, block)
+					}
+				}
 			}
-			//log.Printf("Received ACK for packet %d\n", ack.BlockNumber)
-			if ack.BlockNumber >= uint16(base) { //If the block number is greater than or equal to the base number
-				base = int(ack.BlockNumber + 1) //Set the base to the block number plus 1
+		case *tftp.Term, *tftp.Error:
+			if err = c.peerEnded(ack); err != nil {
+				return err
 			}
 		default: // Default case for unexpected packets
-			log.Printf("Received unexpected packet: %v\n", packet)
-			log.Printf("Window size: %d, base: %d, nextSeqNum: %d\n", WindowSize, base, nextSeqNum)
+			log.Printf("Received unexpected %s packet, window base %d, next %d\n", decoded.Opcode(), base, next)
 		}
-
 	}
 
-	// Check if all packets have been sent and acknowledged
-	if base > len(c.dataBlocks) {
-		log.Printf("All packets sent and acknowledged\n")
-		return nil
+	log.Printf("All packets sent and acknowledged\n")
+	return nil
+}
+
+// peerEnded returns the error a TERM or ERROR from the receiver ends the
+// transfer with.  A late acknowledgement of a TERM of ours ends nothing.
+func (c *TFTPProtocol) peerEnded(p tftp.Packet) error {
+	switch p := p.(type) {
+	case *tftp.Term: //The peer tore the session down
+		if !p.Ack {
+			return c.acknowledgeTerm(p)
+		}
+	case *tftp.Error: //The peer gave up on the transfer
+		log.Printf("Peer aborted transfer: %s\n", p)
+		return tftp.NewErr(p.ErrorCode, append([]byte(nil), p.ErrorMessage...))
 	}
+	return nil
+}
 
+// sendBlock reads block n of the content, frames it for the session and
+// sends it to ap
+func (c *TFTPProtocol) sendBlock(n int, ap netip.AddrPort) error {
+	block, err := c.readBlock(n)
+	if err != nil {
+		c.sendError(tftp.CodeNotDefined, "Error reading file")
+		return err
+	}
+	packet, err := c.sealData(block)
+	if err != nil {
+		return fmt.Errorf("sealing block %d: %w", n, err)
+	}
+	c.pace(len(packet)) // Hold back while over the send rate limits
+	if _, err = c.conn.WriteToUDPAddrPort(packet, ap); err != nil {
+		return fmt.Errorf("sending block %d: %w", n, err)
+	}
+	c.progress.Add(int64(len(block.Data)))
 	return nil
 }
+
+// retryBudget returns how often a block is sent again before the transfer
+// is given up on.  Server sessions use the budget they started with.
+func (c *TFTPProtocol) retryBudget() int {
+	if s := c.settings.Load(); s != nil {
+		return s.retries
+	}
+	return Retries
+}
+
+// awaitInitialAck reads the ACK for block 0 the client sends in answer to
+// our OACK, sending the OACK again each time it does not arrive in time,
+// with the delay doubled, for up to budget times.  ACK 0 comes in the clear,
+// but one sealed with the session key is taken as well.  A TERM or ERROR
+// only counts sealed once the session has a key, anything else is skipped.
+func (c *TFTPProtocol) awaitInitialAck(addr *net.UDPAddr, budget int) error {
+	delay, tries := c.timeout, 0
+	deadline := time.Now().Add(delay)
+	for {
+		c.conn.SetReadDeadline(deadline)
+		n, err := c.readPacket(*c.readBuf) //Read the initial ACK
+		if t := c.aborted(); t != nil {
+			return c.terminate(t.Reason)
+		}
+		var nErr net.Error
+		if errors.As(err, &nErr) && nErr.Timeout() {
+			if tries++; tries > budget {
+				return fmt.Errorf("OACK unacknowledged after %d retransmissions", budget)
+			}
+			if delay *= 2; delay > maxRetransmitDelay {
+				delay = maxRetransmitDelay
+			}
+			deadline = time.Now().Add(delay)
+			c.replayOack() // The OACK or its ACK got lost
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("error reading initial ACK: %w", err)
+		}
+		packet := (*c.readBuf)[:n]               //Trim the packet to the size of the data received
+		decoded, err := c.decoder.Decode(packet) // ACK 0 comes in the clear
+		if _, ack := decoded.(*tftp.Ack); !ack && c.encrypted() {
+			decoded, err = c.decodeSession(packet) // Anything else has to authenticate
+		}
+		if err != nil {
+			log.Printf("Error parsing initial ACK: %s\n", err)
+			continue
+		}
+		switch p := decoded.(type) {
+		case *tftp.Ack:
+			log.Printf("Initial ACK received: %v\n", p)
+			if p.BlockNumber != 0 { //Check if the block number is 0 got initial ACK
+				c.sendErrorClient(tftp.CodeIllegalOperation, "Expected initial block number to be 0", addr)
+				return errors.New("error parsing ack packet: block number should be 0, expecting initial block")
+			}
+			return nil
+		case *tftp.Term, *tftp.Error:
+			if err = c.peerEnded(p); err != nil {
+				return err
+			}
+		default:
+			log.Printf("Received unexpected %s packet waiting for the initial ACK\n", decoded.Opcode())
+		}
+	}
+}
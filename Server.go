@@ -2,55 +2,115 @@ package main
 
 import (
 	"CSC445_Assignment2/tftp"
-	"encoding/binary"
+	"context"
+	"errors"
 	"log"
-	"math/rand"
 	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 func NewTFTPServer() (*TFTPProtocol, error) {
+	settings, err := newServerSettings()
+	if err != nil {
+		log.Println("Error configuring server:", err)
+		return nil, err
+	}
 	addr := &net.UDPAddr{IP: net.IPv4zero, Port: Port}
+	if Listen != "" {
+		addr.IP = net.ParseIP(Listen)
+	}
 	conn, err := net.ListenUDP("udp", addr)
 	if err != nil {
 		log.Println("Error starting server:", err)
 		return nil, err
 	}
-	return &TFTPProtocol{conn: conn, raddr: addr}, nil
+	cookies, err := NewCookieJar()
+	if err != nil {
+		conn.Close()
+		log.Println("Error creating cookie secret:", err)
+		return nil, err
+	}
+	sessions := NewSessionManager(MaxSessions, MaxClientSessions, time.Duration(IdleTimeout)*time.Second)
+	server := &TFTPProtocol{conn: conn, raddr: addr, sessions: sessions, stats: new(ServerStats), cookies: cookies}
+	server.settings.Store(settings)
+	return server, nil
 }
-func NewTFTPServer2() (*TFTPProtocol, error, int) {
-	// Random port
-	port := rand.Intn(65535)
-	addr := &net.UDPAddr{IP: net.IPv4zero, Port: port}
+
+// NewTFTPSession binds the socket for a session serving a request from
+// peer.  Every session gets a fresh ephemeral port, its transfer ID, so the
+// listening socket is free for new requests while the transfer runs.
+func NewTFTPSession(peer *net.UDPAddr) (*TFTPProtocol, error) {
+	addr := &net.UDPAddr{IP: net.IPv4zero, Port: 0} // Let the system pick the port
 	conn, err := net.ListenUDP("udp", addr)
 	if err != nil {
-		log.Println("Error starting server:", err)
-		return nil, err, 0
+		log.Println("Error starting session:", err)
+		return nil, err
 	}
-	return &TFTPProtocol{conn: conn, raddr: addr}, nil, port
+	ctx, cancel := context.WithCancel(context.Background())
+	return &TFTPProtocol{conn: conn, raddr: peer, peer: unmapped(peer.AddrPort()), ctx: ctx, cancel: cancel}, nil
 }
 
-func RunServerMode() {
+// RunServerMode serves requests until SIGINT or SIGTERM and then shuts the
+// server down gracefully, returning a summary of how the sessions in flight
+// ended.  SIGHUP reloads the config file.
+func RunServerMode() ShutdownSummary {
 	udpServer, err := NewTFTPServer()
 	if err != nil {
 		log.Println("Error creating server:", err)
-		return
+		return ShutdownSummary{}
 	}
-	defer udpServer.Close()
-	udpServer.handleConnectionsUDP2() // Launch in separate goroutine
-	select {}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	go udpServer.handleConnectionsUDP2() // Launch in separate goroutine
+	for ctx.Err() == nil {
+		select {
+		case <-hup:
+			if err := udpServer.reload(); err != nil {
+				log.Printf("Error reloading configuration, keeping the current settings: %s\n", err)
+			}
+		case <-ctx.Done():
+		}
+	}
+	stop() // A second signal kills the process the usual way
+
+	drain := time.Duration(DrainTimeout) * time.Second
+	log.Printf("Shutting down, draining sessions for up to %s\n", drain)
+	summary := udpServer.Shutdown(drain)
+	log.Printf("Server stopped: %s\n", summary)
+	log.Printf("Server stats: %s\n", udpServer.stats)
+	return summary
+}
+
+// Shutdown stops accepting requests by closing the listening socket, lets
+// the sessions in flight finish for up to drain and terminates the rest
+func (c *TFTPProtocol) Shutdown(drain time.Duration) ShutdownSummary {
+	if err := c.Close(); err != nil {
+		log.Println("Error closing listener:", err)
+	}
+	return c.sessions.Shutdown(drain)
 }
 
 func (c *TFTPProtocol) handleConnectionsUDP2() {
-	buf := make([]byte, 516)
+	buf := make([]byte, maxDatagram)
 	for {
 		// Read message
 		n, raddr, err := c.conn.ReadFromUDP(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return // Shutting down
+		}
 		if err != nil {
 			log.Println("Error reading message:", err)
 			continue
 		}
-		// decode message
-		msg := buf[:n]
+		// decode message, from a copy as the request outlives the buffer in
+		// its session
+		msg := append([]byte(nil), buf[:n]...)
 		c.handleRequestWithRecovery(raddr, msg)
 	}
 }
@@ -65,22 +125,110 @@ func (c *TFTPProtocol) handleRequestWithRecovery(raddr *net.UDPAddr, msg []byte)
 }
 
 func (c *TFTPProtocol) handleRequest(addr *net.UDPAddr, buf []byte) {
-	code := binary.BigEndian.Uint16(buf[:2])
-	switch tftp.TFTPOpcode(code) {
-	case tftp.TFTPOpcodeRRQ:
-		c.handleRRQ(addr, buf)
-	case tftp.TFTPOpcodeWRQ:
-		// send error packet
-		c.sendError(11, "Write requests are not supported at this time")
-	case tftp.TFTPOpcodeERROR:
+	packet, err := tftp.Decode(buf)
+	if errors.Is(err, tftp.ErrInvalidOption) {
+		log.Printf("Rejecting request from %s: %s\n", addr, err)
+		c.sendErrorClient(tftp.CodeOptionNegotiation, err.Error(), addr)
+		return
+	}
+	if err != nil {
+		log.Printf("Error decoding packet from %s: %s\n", addr, err)
+		c.sendErrorClient(tftp.CodeIllegalOperation, "Illegal TFTP operation", addr)
+		return
+	}
+	settings := c.settings.Load()
+	switch p := packet.(type) {
+	case *tftp.Request:
+		// Admission is decided before a session, keys or an upstream fetch
+		// are spent on the request
+		c.stats.Requests.Add(1)
+		client := addr.AddrPort().Addr()
+		if !settings.acl.Permits(client) {
+			log.Printf("Refusing request from %s: not allowed by the ACL\n", addr)
+			c.stats.Denied.Add(1)
+			c.sendErrorClient(tftp.CodeAccessViolation, "Access denied", addr)
+			return
+		}
+		if settings.requireCookie && !c.cookies.Verify(unmapped(addr.AddrPort()), p.Options["cookie"], time.Now()) {
+			c.challenge(addr, p)
+			return
+		}
+		if session := c.sessions.Lookup(unmapped(addr.AddrPort()), string(p.Filename)); session != nil {
+			if !settings.limiter.AllowRequest(client) {
+				c.stats.RateLimited.Add(1) // Dropped quietly, an error would end the real client's transfer
+				return
+			}
+			c.stats.Replayed.Add(1) // The client resent its request, the session it has answers it
+			session.replayOack()
+			return
+		}
+		if !settings.limiter.AllowRequest(client) {
+			c.stats.RateLimited.Add(1)
+			c.sendErrorClient(tftp.CodeAccessViolation, "Rate limit exceeded, try again later", addr)
+			return
+		}
+		if p.Opcode() == tftp.TFTPOpcodeWRQ && settings.storage == nil {
+			// send error packet
+			c.sendErrorClient(tftp.CodeIllegalOperation, "Write requests are not supported at this time", addr)
+			return
+		}
+		log.Printf("Received %d bytes from %s for file %s \n", len(buf), addr.String(), string(p.Filename))
+		session, err := c.sessions.Open(addr, string(p.Filename))
+		if err != nil {
+			log.Printf("Refusing request from %s: %s\n", addr, err)
+			c.sendErrorClient(tftp.CodeNotDefined, "Unable to start session: "+err.Error(), addr)
+			return
+		}
+		session.settings.Store(settings)
+		session.stats = c.stats
+		go c.sessions.Run(session, addr, p)
+	case *tftp.Error:
 		log.Println("Received ERROR packet, Terminating Connection...")
 		return
-	case tftp.TFTPOpcodeTERM:
+	case *tftp.Term:
 		log.Println("Received TERM, Terminating Connection...")
+		if !p.Ack {
+			// There is no session left for it, acknowledge so the peer stops resending
+			c.conn.WriteToUDP(tftp.NewTermAck(p.Reason).ToBytes(), addr)
+		}
 		return
 	default:
 		log.Println("Packet context invalid, sending error packet...")
-		c.sendError(4, "Illegal TFTP operation")
+		c.sendErrorClient(tftp.CodeIllegalOperation, "Illegal TFTP operation", addr)
+		return
+	}
+}
+
+// challenge answers a request without a valid cookie with a fresh one in
+// an OACK from the listening port.  Nothing is spent on the request until
+// the client echoes the cookie in a new request, which proves it receives
+// packets sent to its address.  A request without options can not be
+// answered with an OACK, RFC 2347, so it is refused.
+func (c *TFTPProtocol) challenge(addr *net.UDPAddr, req *tftp.Request) {
+	c.stats.Challenged.Add(1)
+	if len(req.Options) == 0 {
+		c.sendErrorClient(tftp.CodeAccessViolation, "Cookie required, request with options to receive one", addr)
+		return
+	}
+	oack := tftp.NewOack()
+	oack.Extensions = tftp.Options{"cookie": c.cookies.Issue(unmapped(addr.AddrPort()), time.Now())}
+	c.conn.WriteToUDP(oack.ToBytes(), addr)
+}
+
+// serve runs a session for one request on its own goroutine and closes its
+// socket, releasing the transfer ID, when the transfer is over
+func (c *TFTPProtocol) serve(addr *net.UDPAddr, req *tftp.Request) {
+	defer c.Close()
+	defer c.cancel()
+	defer func() {
+		if r := recover(); r != nil {
+			log.Println("Recovered from panic in session:", r)
+		}
+	}()
+	log.Printf("Serving %s from port %d\n", addr, c.conn.LocalAddr().(*net.UDPAddr).Port)
+	if req.Opcode() == tftp.TFTPOpcodeWRQ {
+		c.handleWRQ(addr, req)
 		return
 	}
+	c.handleRRQ(addr, req)
 }
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"CSC445_Assignment2/tftp"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrTooManySessions is returned when the server already runs as many
+// sessions as it is allowed to
+var ErrTooManySessions = errors.New("too many sessions")
+
+// ErrTooManyClientSessions is returned when a client already runs as many
+// sessions as a single client is allowed to
+var ErrTooManyClientSessions = errors.New("too many sessions for this client")
+
+// ErrShuttingDown is returned for requests that arrive while the server
+// shuts down
+var ErrShuttingDown = errors.New("server is shutting down")
+
+// SessionState is where a session is in its lifecycle
+type SessionState int32
+
+const (
+	SessionNegotiating  SessionState = iota // Fetching the file and negotiating options
+	SessionTransferring                     // Sending or receiving data blocks
+	SessionTerminating                      // Tearing the session down
+	SessionCompleted                        // The file was transferred in full
+)
+
+func (s SessionState) String() string {
+	switch s {
+	case SessionNegotiating:
+		return "negotiating"
+	case SessionTransferring:
+		return "transferring"
+	case SessionTerminating:
+		return "terminating"
+	case SessionCompleted:
+		return "completed"
+	default:
+		return "unknown"
+	}
+}
+
+// SessionKey identifies a session by the client's address and port and the
+// server port serving it, the two transfer IDs of the transfer
+type SessionKey struct {
+	Peer netip.AddrPort
+	TID  uint16
+}
+
+// SessionInfo is a snapshot of one active session
+type SessionInfo struct {
+	Key   SessionKey
+	File  string
+	Bytes int64           // File bytes sent or received so far, retransmissions included
+	State SessionState    // Lifecycle state
+	Age   time.Duration   // Time since the request was accepted
+	Idle  time.Duration   // Time since the client was last heard from
+	RTT   RTTStats        // Round trip times to the client
+	Cwnd  CongestionStats // Congestion window of a session sending to the client
+}
+
+// managedSession is a session the manager keeps track of
+type managedSession struct {
+	proto   *TFTPProtocol
+	file    string
+	started time.Time
+}
+
+// SessionManager owns the sessions of a server.  It hands every accepted
+// request its own TFTPProtocol on its own transfer ID, caps how many run at
+// once overall and per client, aborts sessions whose client went quiet, and
+// lets other components list and cancel sessions.  A limit of 0 means no
+// limit.
+type SessionManager struct {
+	maxSessions  int           // Sessions allowed at once
+	maxPerClient int           // Sessions allowed at once per client address
+	idleTimeout  time.Duration // Quiet time after which a transfer is aborted
+
+	mu        sync.Mutex
+	sessions  map[SessionKey]*managedSession
+	peers     map[netip.AddrPort]SessionKey // Latest session by client transfer ID
+	clients   map[netip.Addr]int            // Sessions per client address
+	closed    bool                          // Shutting down, no new sessions are opened
+	completed int                           // Sessions that transferred their file
+	failed    int                           // Sessions that ended with an error or were cancelled by the client
+	aborted   int                           // Sessions cancelled on our side
+	running   sync.WaitGroup                // Sessions that have not been forgotten yet
+	stop      chan struct{}
+}
+
+// ShutdownSummary reports how the sessions in flight when a server started
+// shutting down ended
+type ShutdownSummary struct {
+	InFlight  int           // Sessions running when the shutdown started
+	Completed int           // Sessions that transferred their file before the drain deadline
+	Failed    int           // Sessions that ended with an error
+	Aborted   int           // Sessions still running at the drain deadline, terminated with a TERM
+	Elapsed   time.Duration // Time the shutdown took
+}
+
+// String formats the summary for the log
+func (s ShutdownSummary) String() string {
+	return fmt.Sprintf("%d sessions in flight: %d completed, %d failed, %d aborted in %s",
+		s.InFlight, s.Completed, s.Failed, s.Aborted, s.Elapsed.Round(time.Millisecond))
+}
+
+// NewSessionManager creates a session manager and starts expiring idle
+// sessions
+func NewSessionManager(maxSessions, maxPerClient int, idleTimeout time.Duration) *SessionManager {
+	m := &SessionManager{
+		maxSessions:  maxSessions,
+		maxPerClient: maxPerClient,
+		idleTimeout:  idleTimeout,
+		sessions:     make(map[SessionKey]*managedSession),
+		peers:        make(map[netip.AddrPort]SessionKey),
+		clients:      make(map[netip.Addr]int),
+		stop:         make(chan struct{}),
+	}
+	go m.expire()
+	return m
+}
+
+// SetLimits changes the session limits and the idle timeout.  Sessions
+// already running are not cut to fit new limits.
+func (m *SessionManager) SetLimits(maxSessions, maxPerClient int, idleTimeout time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.maxSessions, m.maxPerClient, m.idleTimeout = maxSessions, maxPerClient, idleTimeout
+}
+
+// Open starts a session for a request for file from peer, binding it to a
+// fresh transfer ID, unless a session limit has been reached
+func (m *SessionManager) Open(peer *net.UDPAddr, file string) (*TFTPProtocol, error) {
+	client := unmapped(peer.AddrPort()).Addr()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return nil, ErrShuttingDown
+	}
+	if m.maxSessions > 0 && len(m.sessions) >= m.maxSessions {
+		return nil, ErrTooManySessions
+	}
+	if m.maxPerClient > 0 && m.clients[client] >= m.maxPerClient {
+		return nil, ErrTooManyClientSessions
+	}
+
+	session, err := NewTFTPSession(peer)
+	if err != nil {
+		return nil, err
+	}
+	session.touch()
+	key := session.sessionKey()
+	m.sessions[key] = &managedSession{proto: session, file: file, started: time.Now()}
+	m.peers[key.Peer] = key
+	m.clients[client]++
+	m.running.Add(1)
+	return session, nil
+}
+
+// Lookup returns the session serving a request for file from the client
+// transfer ID peer, or nil when there is none.  A client that resends its
+// request gets the session it already has rather than a new one.
+func (m *SessionManager) Lookup(peer netip.AddrPort, file string) *TFTPProtocol {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[m.peers[peer]]
+	if !ok || s.file != file {
+		return nil
+	}
+	return s.proto
+}
+
+// Run serves a request on a session returned by Open and forgets the
+// session once the transfer is over
+func (m *SessionManager) Run(session *TFTPProtocol, addr *net.UDPAddr, req *tftp.Request) {
+	defer m.remove(session)
+	session.serve(addr, req)
+}
+
+// remove forgets a session and counts how it ended
+func (m *SessionManager) remove(session *TFTPProtocol) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := session.sessionKey()
+	if _, ok := m.sessions[key]; !ok {
+		return
+	}
+	delete(m.sessions, key)
+	log.Printf("Session %s port %d ended, round trip time %s, congestion window %s\n", key.Peer, key.TID, session.rtt.stats(), session.cwnd.stats())
+	if m.peers[key.Peer] == key {
+		delete(m.peers, key.Peer)
+	}
+	if m.clients[key.Peer.Addr()]--; m.clients[key.Peer.Addr()] <= 0 {
+		delete(m.clients, key.Peer.Addr())
+	}
+	switch {
+	case session.aborted() != nil:
+		m.aborted++
+	case SessionState(session.state.Load()) == SessionCompleted:
+		m.completed++
+	default:
+		m.failed++
+	}
+	m.running.Done()
+}
+
+// Snapshot returns the active sessions, oldest first
+func (m *SessionManager) Snapshot() []SessionInfo {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	infos := make([]SessionInfo, 0, len(m.sessions))
+	for key, s := range m.sessions {
+		infos = append(infos, SessionInfo{
+			Key:   key,
+			File:  s.file,
+			Bytes: s.proto.progress.Load(),
+			State: SessionState(s.proto.state.Load()),
+			Age:   now.Sub(s.started),
+			Idle:  now.Sub(time.Unix(0, s.proto.lastActive.Load())),
+			RTT:   s.proto.rtt.stats(),
+			Cwnd:  s.proto.cwnd.stats(),
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Age > infos[j].Age })
+	return infos
+}
+
+// Cancel aborts a session with reason and reports whether it was found.
+// The session tears itself down with a TERM and is forgotten once it has.
+func (m *SessionManager) Cancel(key SessionKey, reason tftp.TermReason) bool {
+	m.mu.Lock()
+	s, ok := m.sessions[key]
+	m.mu.Unlock()
+	if ok {
+		log.Printf("Cancelling session %s port %d: %s\n", key.Peer, key.TID, reason)
+		s.proto.Abort(reason)
+	}
+	return ok
+}
+
+// CancelAll aborts every session with reason and returns how many there were
+func (m *SessionManager) CancelAll(reason tftp.TermReason) int {
+	m.mu.Lock()
+	sessions := make([]*managedSession, 0, len(m.sessions))
+	for _, s := range m.sessions {
+		sessions = append(sessions, s)
+	}
+	m.mu.Unlock()
+	for _, s := range sessions {
+		s.proto.Abort(reason)
+	}
+	return len(sessions)
+}
+
+// Stop stops expiring idle sessions
+func (m *SessionManager) Stop() {
+	close(m.stop)
+}
+
+// Shutdown stops opening sessions and lets the running ones finish for up to
+// drain.  Sessions still running after that are terminated with a TERM, and
+// Shutdown returns once every session let go of its transfer ID.
+func (m *SessionManager) Shutdown(drain time.Duration) ShutdownSummary {
+	start := time.Now()
+	m.mu.Lock()
+	m.closed = true
+	summary := ShutdownSummary{InFlight: len(m.sessions)}
+	completed, failed, aborted := m.completed, m.failed, m.aborted
+	m.mu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		m.running.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-time.After(drain):
+		log.Printf("Drain deadline passed, terminating %d sessions\n", m.CancelAll(tftp.TermShutdown))
+		<-drained // Every session runs its TERM handshake and lets go
+	}
+	m.Stop()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	summary.Completed = m.completed - completed
+	summary.Failed = m.failed - failed
+	summary.Aborted = m.aborted - aborted
+	summary.Elapsed = time.Since(start)
+	return summary
+}
+
+// expireInterval is how often sessions are checked for the idle timeout
+const expireInterval = 500 * time.Millisecond
+
+// expire aborts transferring sessions whose client has not been heard from
+// for the idle timeout.  Sessions still fetching their file are waiting on
+// the upstream rather than the client and are left alone.
+func (m *SessionManager) expire() {
+	ticker := time.NewTicker(expireInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+		}
+		m.mu.Lock()
+		idleTimeout := m.idleTimeout
+		m.mu.Unlock()
+		if idleTimeout <= 0 {
+			continue // Sessions never expire
+		}
+		for _, info := range m.Snapshot() {
+			if info.State == SessionTransferring && info.Idle > idleTimeout {
+				log.Printf("Session %s idle for %s, expiring\n", info.Key.Peer, info.Idle.Round(time.Second))
+				m.Cancel(info.Key, tftp.TermTimeout)
+			}
+		}
+	}
+}
+
+// sessionKey returns the key a server session is tracked under
+func (c *TFTPProtocol) sessionKey() SessionKey {
+	return SessionKey{Peer: c.peer, TID: uint16(c.conn.LocalAddr().(*net.UDPAddr).Port)}
+}
+
+// setState moves the session to a new lifecycle state
+func (c *TFTPProtocol) setState(state SessionState) {
+	c.state.Store(int32(state))
+	c.touch()
+}
+
+// touch records that the session just made progress
+func (c *TFTPProtocol) touch() {
+	c.lastActive.Store(time.Now().UnixNano())
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNoSource is returned for names no source is configured for
+var ErrNoSource = errors.New("no source for name")
+
+// Source is somewhere the server gets the files clients ask for from
+type Source interface {
+	// Open opens the file called name.  A file that does not exist is
+	// reported with an error wrapping os.ErrNotExist.
+	Open(ctx context.Context, name string) (*Object, error)
+}
+
+// Object is a file opened from a source.  Closing it releases whatever the
+// source holds for it.
+type Object struct {
+	Content                       // The file, read block by block
+	ContentType string            // MIME type, empty when unknown
+	Metadata    map[string]string // Source specific details such as modification times
+}
+
+// route maps names starting with prefix to a source
+type route struct {
+	prefix string
+	strip  bool // Hand the source the name without the prefix
+	source Source
+}
+
+// SourceRouter picks the source for a name by its scheme or prefix.  The
+// longest matching route wins.  A router is a Source itself, so routers
+// can be nested.
+type SourceRouter struct {
+	routes []route
+}
+
+// NewSourceRouter creates a router without routes
+func NewSourceRouter() *SourceRouter {
+	return &SourceRouter{}
+}
+
+// Handle routes names starting with prefix to source, which is handed the
+// name with the prefix removed.  An empty prefix matches every name.
+func (r *SourceRouter) Handle(prefix string, source Source) {
+	r.add(route{prefix: prefix, strip: true, source: source})
+}
+
+// HandleScheme routes URLs with scheme, such as "https", to source, which
+// is handed the whole URL
+func (r *SourceRouter) HandleScheme(scheme string, source Source) {
+	r.add(route{prefix: scheme + "://", source: source})
+}
+
+// add inserts a route, keeping the longest prefixes first
+func (r *SourceRouter) add(rt route) {
+	r.routes = append(r.routes, rt)
+	sort.SliceStable(r.routes, func(i, j int) bool { return len(r.routes[i].prefix) > len(r.routes[j].prefix) })
+}
+
+// Open opens name from the source of the first matching route
+func (r *SourceRouter) Open(ctx context.Context, name string) (*Object, error) {
+	for _, rt := range r.routes {
+		if !strings.HasPrefix(name, rt.prefix) {
+			continue
+		}
+		if rt.strip {
+			name = name[len(rt.prefix):]
+		}
+		return rt.source.Open(ctx, name)
+	}
+	return nil, fmt.Errorf("%w %q: %w", ErrNoSource, name, os.ErrNotExist)
+}
+
+// HTTPSource fetches files over HTTP, the name is the URL.  The response is
+// read into memory as its size is often not known up front.
+type HTTPSource struct {
+	Client *http.Client // Client the requests are made with, http.DefaultClient when nil
+}
+
+// Open fetches the URL name
+func (s *HTTPSource) Open(ctx context.Context, name string) (*Object, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, name, nil)
+	if err != nil {
+		return nil, err
+	}
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		return nil, fmt.Errorf("fetching %s: %s: %w", name, resp.Status, os.ErrNotExist)
+	case resp.StatusCode/100 != 2:
+		return nil, fmt.Errorf("fetching %s: %s", name, resp.Status)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	meta := make(map[string]string)
+	for _, h := range []string{"Last-Modified", "ETag"} {
+		if v := resp.Header.Get(h); v != "" {
+			meta[h] = v
+		}
+	}
+	return &Object{Content: newMemContent(data), ContentType: resp.Header.Get("Content-Type"), Metadata: meta}, nil
+}
+
+// DirSource serves the files under a directory.  Names are slash separated
+// paths relative to Root and can not leave it, see openLocal.
+type DirSource struct {
+	Root string
+}
+
+// Open opens the file name under the root, streamed from disk
+func (s *DirSource) Open(ctx context.Context, name string) (*Object, error) {
+	file, err := openLocal(s.Root, name)
+	if err != nil {
+		return nil, err
+	}
+	meta := map[string]string{"Last-Modified": file.ModTime().UTC().Format(http.TimeFormat)}
+	return &Object{Content: file, ContentType: mime.TypeByExtension(path.Ext(name)), Metadata: meta}, nil
+}
+
+// memFile is a file held by a MemSource
+type memFile struct {
+	data        []byte
+	contentType string
+	modTime     time.Time
+}
+
+// MemSource serves files held in memory, fixtures for tests and demos
+type MemSource struct {
+	mu    sync.RWMutex
+	files map[string]memFile
+}
+
+// NewMemSource creates an empty in-memory source
+func NewMemSource() *MemSource {
+	return &MemSource{files: make(map[string]memFile)}
+}
+
+// Add stores data under name, replacing any earlier file
+func (s *MemSource) Add(name string, data []byte, contentType string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files[name] = memFile{data: data, contentType: contentType, modTime: time.Now()}
+}
+
+// Open returns the file stored under name
+func (s *MemSource) Open(ctx context.Context, name string) (*Object, error) {
+	s.mu.RLock()
+	f, ok := s.files[name]
+	s.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%q: %w", name, os.ErrNotExist)
+	}
+	meta := map[string]string{"Last-Modified": f.modTime.UTC().Format(http.TimeFormat)}
+	return &Object{Content: memContent{bytes.NewReader(f.data)}, ContentType: f.contentType, Metadata: meta}, nil
+}
+
+// defaultSources builds the sources the server is configured with.  URLs
+// are proxied over HTTP unless proxying is turned off, names under a mount
+// prefix are files in the mounted directory and other names are files under
+// the served root.
+func defaultSources() *SourceRouter {
+	router := NewSourceRouter()
+	if Proxy {
+		proxy := &HTTPSource{}
+		router.HandleScheme("http", proxy)
+		router.HandleScheme("https", proxy)
+	}
+	for prefix, dir := range Mounts {
+		router.Handle(prefix, &DirSource{Root: dir})
+	}
+	if Root != "" {
+		router.Handle("", &DirSource{Root: Root})
+	}
+	return router
+}
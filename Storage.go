@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrInvalidName is returned for upload names that are not a plain file name
+var ErrInvalidName = errors.New("invalid file name")
+
+// Storage is where the server keeps uploaded files.  Check is asked before
+// an upload is accepted, Commit stores the whole file once every block has
+// been received and verified, so a failed or cancelled upload never leaves
+// a partial file behind.
+type Storage interface {
+	Check(name string) error               // Whether an upload under name would be accepted
+	Commit(name string, data []byte) error // Store the file atomically, replacing any earlier one
+}
+
+// DirStorage stores uploads as files in a directory
+type DirStorage struct {
+	Dir string
+}
+
+// NewDirStorage creates a storage backend for dir, creating the directory
+// if it does not exist yet
+func NewDirStorage(dir string) (*DirStorage, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &DirStorage{Dir: dir}, nil
+}
+
+// Check accepts plain file names only, so an upload can not escape the
+// directory or create subdirectories
+func (s *DirStorage) Check(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) || strings.ContainsRune(name, 0) {
+		return ErrInvalidName
+	}
+	return nil
+}
+
+// Commit writes data to a temporary file in the directory, syncs it and
+// renames it into place, so readers see either the old file or the whole
+// new one
+func (s *DirStorage) Commit(name string, data []byte) error {
+	if err := s.Check(name); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(s.Dir, ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // Cleans up after a failure, gone after the rename
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(s.Dir, name))
+}
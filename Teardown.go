@@ -0,0 +1,116 @@
+package main
+
+import (
+	"CSC445_Assignment2/tftp"
+	"log"
+	"time"
+)
+
+// termRetries is how often a TERM is sent before the peer is given up on
+const termRetries = 3
+
+// Abort asks the session's transfer loop to tear the session down with
+// reason.  It is safe to call from another goroutine, the loop notices on
+// its next read and runs the TERM handshake with the peer.  A server session
+// still opening its file has the fetch cancelled.  Only the first reason is
+// kept.
+func (c *TFTPProtocol) Abort(reason tftp.TermReason) {
+	if c.abort.CompareAndSwap(nil, tftp.NewTerm(reason)) {
+		c.conn.SetReadDeadline(time.Now()) // Wake up a blocked read
+		if c.cancel != nil {
+			c.cancel() // Stop waiting on the source
+		}
+	}
+}
+
+// aborted returns the TERM requested through Abort, or nil
+func (c *TFTPProtocol) aborted() *tftp.Term {
+	return c.abort.Load()
+}
+
+// terminate tears the session down from our side.  It sends a TERM with
+// reason and waits for the peer to acknowledge it, sending it again after
+// each timeout, before releasing the session state.  A peer that answers
+// with a TERM of its own or an ERROR has let go of the session as well.
+// Stock clients of plaintext sessions get an ERROR instead.  The returned
+// TERM is the error the transfer ends with.
+func (c *TFTPProtocol) terminate(reason tftp.TermReason) *tftp.Term {
+	term := tftp.NewTerm(reason)
+	defer c.releaseSession()
+	defer c.conn.SetReadDeadline(time.Time{})
+	log.Printf("Terminating session: %s\n", reason)
+	c.setState(SessionTerminating)
+	if c.plain {
+		// Stock RFC 1350 clients do not know TERM, an ERROR ends their transfer
+		c.sendError(tftp.CodeTransferAborted, "Transfer aborted: "+reason.String())
+		return term
+	}
+
+	timeout := c.timeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	for try := 0; try < termRetries; try++ {
+		if err := c.sendTerm(term); err != nil {
+			log.Println("Error sending TERM packet:", err)
+			return term
+		}
+		deadline := time.Now().Add(timeout)
+		for {
+			c.conn.SetReadDeadline(deadline)
+			n, err := c.readPacket(*c.readBuf)
+			if err != nil {
+				break // Timed out, send the TERM again
+			}
+			packet, err := c.decodeSession((*c.readBuf)[:n])
+			if err != nil {
+				continue
+			}
+			switch p := packet.(type) {
+			case *tftp.Term:
+				if !p.Ack {
+					c.sendTerm(tftp.NewTermAck(p.Reason)) // Both sides aborted at once
+				}
+				log.Printf("Session terminated\n")
+				return term
+			case *tftp.Error:
+				log.Printf("Peer answered TERM with error: %s\n", p)
+				return term
+			}
+		}
+	}
+	log.Printf("Peer did not acknowledge TERM, releasing session\n")
+	return term
+}
+
+// acknowledgeTerm answers a TERM from the peer and releases the session.
+// The returned copy of the TERM is the error the transfer ends with.
+func (c *TFTPProtocol) acknowledgeTerm(t *tftp.Term) *tftp.Term {
+	log.Printf("Peer terminated session: %s\n", t.Reason)
+	term := tftp.NewTerm(t.Reason) // Copy it out of the reused decoder
+	if err := c.sendTerm(tftp.NewTermAck(t.Reason)); err != nil {
+		log.Println("Error acknowledging TERM packet:", err)
+	}
+	c.releaseSession()
+	return term
+}
+
+// sendTerm seals a TERM for the session and sends it to the peer
+func (c *TFTPProtocol) sendTerm(t *tftp.Term) error {
+	c.acquireBuffers()
+	packet, err := c.sealPacket(t)
+	if err != nil {
+		return err
+	}
+	_, err = c.writePacket(packet)
+	return err
+}
+
+// releaseSession drops the buffers, blocks and keys a session holds so a
+// finished or torn down transfer frees them right away
+func (c *TFTPProtocol) releaseSession() {
+	c.releaseBuffers()
+	c.content = nil
+	c.received = nil
+	c.dhke = nil
+}
@@ -2,77 +2,228 @@ package main
 
 import (
 	"CSC445_Assignment2/tftp"
-	"encoding/binary"
+	"context"
 	"log"
-	"math/big"
 	"net"
-	"sort"
+	"net/netip"
+	"sync/atomic"
 	"time"
 )
 
+// Option defaults and limits from RFC 1350, 2348, 2349 and 7440
+const (
+	defaultBlockSize   = 512                    // RFC 1350 block size
+	minBlockSize       = 8                      // RFC 2348 lower bound
+	maxBlockSize       = 65464                  // RFC 2348 upper bound
+	defaultWindowSize  = 1                      // RFC 1350 lock step
+	maxWindowSize      = 65535                  // RFC 7440 upper bound
+	minTimeout         = 1                      // RFC 2349 lower bound in seconds
+	maxTimeout         = 255                    // RFC 2349 upper bound in seconds
+	defaultTimeout     = 500 * time.Millisecond // Retransmission delay when no timeout is negotiated
+	maxRetransmitDelay = 30 * time.Second       // Longest the retransmission delay backs off to
+	dataHeaderSize     = 8                      // Opcode, block number and checksum
+	aeadOverhead       = 12 + 16                // AES-GCM nonce and tag
+)
+
 type TFTPProtocol struct {
-	conn            *net.UDPConn          // UDP connection
-	raddr           *net.UDPAddr          // Remote address
-	xferSize        uint32                // Size of the file to be transferred
-	blockSize       uint16                // Block size of the data packets
-	windowSize      uint16                //Sliding window size
-	key             []byte                // Key
-	dataBlocks      []*tftp.Data          //Data packets to be sent
-	nextSeqNum      uint16                // Next expected block number
-	totalFrames     int                   // Total number of frames
-	dataThroughIn   int                   // Data throughput in
-	dataThroughOut  int                   // Data throughput out
-	requestStart    int64                 // Time when the request was sent
-	requestEnd      int64                 // Time when the request was received
-	receivedPackets map[uint16]*tftp.Data // Received packets
-	dhke            *DHKESession          // Diffie Hellman Key Exchange
-}
-
-// SetProtocolOptions sets the protocol options for the TFTP protocol
-// using static values for the time being
-func (c *TFTPProtocol) SetProtocolOptions(options map[string][]byte, l int) {
+	conn           *net.UDPConn                   // UDP connection
+	raddr          *net.UDPAddr                   // Remote address
+	peer           netip.AddrPort                 // Peer of a server session, unset when conn is connected
+	xferSize       uint32                         // Size of the file to be transferred
+	blockSize      uint16                         // Block size of the data packets
+	windowSize     uint16                         //Sliding window size
+	timeout        time.Duration                  // Retransmission timeout
+	mode           string                         // Transfer mode, octet or netascii
+	plain          bool                           // Plain RFC 1350 session without checksums or encryption
+	key            []byte                         // Key
+	content        Content                        // File being sent, read block by block
+	block          tftp.Data                      // DATA packet reused for each block sent
+	nextSeqNum     uint64                         // Next expected block number, unwrapped
+	totalFrames    int                            // Total number of frames
+	dataThroughIn  int                            // Data throughput in
+	dataThroughOut int                            // Data throughput out
+	requestStart   int64                          // Time when the request was sent
+	requestEnd     int64                          // Time when the request was received
+	received       []byte                         // File data received so far, in block order
+	rollover       uint16                         // Block number the counter rolls over to after 65535
+	rolloverOK     bool                           // Whether the peer agreed to block number rollover
+	selective      bool                           // Selective Repeat ARQ negotiated instead of Go-Back-N
+	sack           bool                           // SACK packets negotiated, Selective Repeat ACKs are cumulative
+	ahead          map[uint64][]byte              // Blocks a Selective Repeat receiver got ahead of a gap
+	rtt            rttEstimator                   // Round trip time to the peer, drives the retransmission timer
+	cwnd           congestionWindow               // Blocks a sender keeps in flight, up to the window size
+	probe          ackProbe                       // ACK a receiver times the round trip of
+	dhke           *DHKESession                   // Diffie Hellman Key Exchange
+	readBuf        *[]byte                        // Pooled buffer datagrams are read into
+	plainBuf       *[]byte                        // Pooled buffer received packets are decrypted into
+	writeBuf       *[]byte                        // Pooled buffer outgoing packets are sealed in
+	blockBuf       *[]byte                        // Pooled buffer blocks of the content are read into
+	decoder        tftp.Decoder                   // Packets reused by the transfer loops
+	ack            tftp.Ack                       // ACK reused by sendAck
+	sackPack       tftp.Sack                      // SACK reused by sendSack
+	sackHeld       []uint64                       // Blocks held past a gap, reused by sendSack to sort them
+	abort          atomic.Pointer[tftp.Term]      // TERM requested through Abort
+	sessions       *SessionManager                // Sessions of a listening server
+	stats          *ServerStats                   // Counters of a server, shared with its sessions
+	cookies        *CookieJar                     // Return-routability cookies of a listening server
+	request        *tftp.Request                  // Request of a client, resent until the server answers
+	oack           atomic.Pointer[[]byte]         // OACK a server session sent, replayed until the client answers it
+	lastReplay     atomic.Int64                   // Unix nanoseconds the OACK was last replayed
+	state          atomic.Int32                   // SessionState of a server session
+	progress       atomic.Int64                   // File bytes sent or received by a server session
+	lastActive     atomic.Int64                   // Unix nanoseconds the peer was last heard from
+	settings       atomic.Pointer[serverSettings] // Reloadable server settings, fixed for a session once it starts
+	ctx            context.Context                // Cancelled when a server session is aborted or over
+	cancel         context.CancelFunc             // Cancels ctx
+	quota          int64                          // Largest upload a receiving session accepts, 0 for no limit
+}
+
+// requestedBlockSize returns the block size options negotiate, the one asked
+// for lowered to the configured limit, or the RFC 1350 default
+func (c *TFTPProtocol) requestedBlockSize(options tftp.Options) uint16 {
+	v, ok := options.Uint("blksize")
+	if !ok {
+		return defaultBlockSize
+	}
+	if limit := uint64(c.settings.Load().blockSize); v > limit {
+		v = limit
+	}
+	return uint16(v)
+}
+
+// SetProtocolOptions negotiates the options requested by a client against
+// the configured limits, sets the accepted values on the protocol and
+// returns them in an OACK.  l is the size of the file being served.
+// Option values have already been range checked by the tftp option
+// registry, options the client did not ask for are left out of the OACK so
+// it falls back to the RFC 1350 defaults for them.
+func (c *TFTPProtocol) SetProtocolOptions(options tftp.Options, l int) *tftp.OptionAcknowledgement {
+	oack := tftp.NewOack()
+	c.blockSize, c.windowSize, c.timeout = defaultBlockSize, defaultWindowSize, defaultTimeout
+
 	if l != 0 {
 		c.SetTransferSize(uint32(l))
 	}
-	if options["tsize"] != nil && c.xferSize == 0 {
-		c.SetTransferSize(binary.BigEndian.Uint32(options["tsize"]))
+	// A tsize of 0 in a RRQ asks the server for the size of the file
+	if v, ok := options.Uint("tsize"); ok && v == 0 && c.xferSize > 0 {
+		oack.XferSize = c.xferSize
+	}
+	// The server may only lower the requested block and window sizes
+	if _, ok := options.Uint("blksize"); ok {
+		c.blockSize = c.requestedBlockSize(options)
+		oack.BlkSize = c.blockSize
+	}
+	if v, ok := options.Uint("windowsize"); ok {
+		if limit := uint64(c.settings.Load().windowSize); v > limit {
+			v = limit
+		}
+		c.windowSize = uint16(v)
+		oack.Windowsize = c.windowSize
 	}
-	if options["blksize"] != nil {
-		c.blockSize = binary.BigEndian.Uint16(options["blksize"])
+	// The timeout has to be honoured exactly or not at all
+	if v, ok := options.Uint("timeout"); ok {
+		c.timeout = time.Duration(v) * time.Second
+		oack.Timeout = uint16(v)
 	}
-	if options["windowsize"] != nil {
-		c.windowSize = binary.BigEndian.Uint16(options["windowsize"])
+	// Echo the rollover value so block numbers can wrap on large files
+	c.rollover, c.rolloverOK = 0, false
+	if v, ok := options.Uint("rollover"); ok {
+		c.rollover, c.rolloverOK = uint16(v), true
+		oack.Extensions = tftp.Options{}
+		oack.Extensions.SetUint("rollover", v)
+	}
+	// Selective Repeat only changes how blocks are acknowledged, it is
+	// granted whenever it is asked for
+	c.selective = false
+	if v, ok := options.Uint("selrepeat"); ok {
+		c.selective = v == 1
+		if oack.Extensions == nil {
+			oack.Extensions = tftp.Options{}
+		}
+		oack.Extensions.SetUint("selrepeat", v)
+	}
+	// SACKs report the blocks a Selective Repeat receiver holds past a gap,
+	// a Go-Back-N receiver drops them so it has nothing to report
+	c.sack = false
+	if v, ok := options.Uint("sack"); ok && c.selective {
+		c.sack = v == 1
+		oack.Extensions.SetUint("sack", v)
 	}
 	if options["key"] != nil {
 		c.key = options["key"]
 	}
-	if options["keyy"] != nil {
-		v := new(big.Int)
-		v.SetBytes(options["keyy"])
-		c.key = options["keyy"]
+	return oack
+}
+
+// maxPacketSize returns the largest encrypted DATA packet for the
+// negotiated block size
+func (c *TFTPProtocol) maxPacketSize() int {
+	return int(c.blockSize) + dataHeaderSize + aeadOverhead
+}
+
+// readPacket reads the next datagram from the peer.  Datagrams from any
+// other transfer ID are answered with an Unknown TID error and skipped
+// without disturbing the transfer, as RFC 1350 asks.  Until the peer is
+// known datagrams are accepted from anyone.
+func (c *TFTPProtocol) readPacket(buf []byte) (int, error) {
+	if !c.peer.IsValid() {
+		return c.conn.Read(buf)
+	}
+	for {
+		n, addr, err := c.conn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			return n, err
+		}
+		if unmapped(addr) == c.peer {
+			c.touch()
+			return n, nil
+		}
+		c.rejectTID(addr)
 	}
-	if options["keyx"] != nil {
-		// convert to big int
-		v := new(big.Int)
-		v.SetBytes(options["keyx"])
-		c.key = options["keyx"]
+}
+
+// rejectTID answers a datagram that arrived from the wrong transfer ID
+func (c *TFTPProtocol) rejectTID(addr netip.AddrPort) {
+	log.Printf("Packet from unknown transfer ID %s, expected %s\n", addr, c.peer)
+	errPack := tftp.NewErr(tftp.CodeUnknownTID, []byte("Unknown transfer ID"))
+	if _, err := c.conn.WriteToUDPAddrPort(errPack.ToBytes(), addr); err != nil {
+		log.Println("Error sending error packet:", err)
 	}
+}
+
+// unmapped turns an IPv4 mapped IPv6 address back into IPv4, so a peer
+// compares equal however the socket reported it
+func unmapped(addr netip.AddrPort) netip.AddrPort {
+	return netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
+}
 
-	c.blockSize = 512
-	c.windowSize = uint16(WindowSize)
+// writePacket sends a datagram to the peer.  Until the peer is known it goes
+// to the address the request was sent to.
+func (c *TFTPProtocol) writePacket(packet []byte) (int, error) {
+	if !c.peer.IsValid() {
+		return c.conn.WriteToUDP(packet, c.raddr)
+	}
+	return c.conn.WriteToUDPAddrPort(packet, c.peer)
 }
 
-func (c *TFTPProtocol) sendError(errCode uint16, errMsg string) {
+// sendError sends an ERROR to the peer, sealed once the session has a key
+// as the peer only accepts authenticated packets then
+func (c *TFTPProtocol) sendError(errCode tftp.ErrorCode, errMsg string) {
 	log.Printf("Sending error packet: %d %s\n", errCode, errMsg)
-	errPack := tftp.NewErr(errCode, []byte(errMsg))
-	_, err := c.conn.Write(errPack.ToBytes())
+	c.acquireBuffers()
+	packet, err := c.sealPacket(tftp.NewErr(errCode, []byte(errMsg)))
+	if err != nil {
+		log.Println("Error sealing error packet:", err)
+		return
+	}
+	_, err = c.writePacket(packet)
 	if err != nil {
 		log.Println("Error sending error packet:", err)
 		return
 	}
 }
 
-func (c *TFTPProtocol) sendErrorClient(errCode uint16, errMsg string, raddr *net.UDPAddr) {
+func (c *TFTPProtocol) sendErrorClient(errCode tftp.ErrorCode, errMsg string, raddr *net.UDPAddr) {
 	log.Printf("Sending error packet: %d %s\n", errCode, errMsg)
 	errPack := tftp.NewErr(errCode, []byte(errMsg))
 	_, err := c.conn.WriteToUDP(errPack.ToBytes(), raddr)
@@ -83,50 +234,42 @@ func (c *TFTPProtocol) sendErrorClient(errCode uint16, errMsg string, raddr *net
 }
 
 func (c *TFTPProtocol) sendAbort() {
-	c.sendError(9, "Aborting transfer")
+	c.sendError(tftp.CodeTransferAborted, "Aborting transfer")
 }
 
-func (c *TFTPProtocol) sendAck(nextSeqNum uint16) {
-	ack := tftp.NewAck(nextSeqNum)
-	ackPack, _ := encrypt(ack.ToBytes(), c.dhke.aes512Key)
-	n, err := c.conn.Write(ackPack)
-	c.ADto(n)
+// sendAck seals an ACK for an unwrapped block number in the session's write
+// buffer and sends it
+func (c *TFTPProtocol) sendAck(nextSeqNum uint64) {
+	c.ack.BlockNumber = tftp.WireBlock(nextSeqNum, c.rollover)
+	ackPack, err := c.sealPacket(&c.ack)
 	if err != nil {
-		log.Println("Error sending ACK packet:", err)
+		log.Println("Error sealing ACK packet:", err)
 		return
 	}
-}
-
-// HandleErrPacket handles an error packet but currently just sends an error
-// back so relying on timeout to close the connection.  Should probably
-// implement a proper connection close.
-func (c *TFTPProtocol) handleErrPacket(packet []byte) {
-	var errPack tftp.Error
-	err := errPack.Parse(packet)
+	n, err := c.writePacket(ackPack)
+	c.ADto(n)
 	if err != nil {
-		log.Println("Error parsing error packet:", err)
-		c.sendError(22, "Error parsing error packet")
+		log.Println("Error sending ACK packet:", err)
 		return
 	}
-	c.sendError(errPack.ErrorCode, string(errPack.ErrorMessage))
-	return
+	c.markAck(nextSeqNum)
 }
 
 func (c *TFTPProtocol) SetTransferSize(size uint32) {
 	c.xferSize = size
 }
 
-// AppendFileDate appends the file date to the data packet
-// and also keeps track of duplicate packets and discards \
-// any already stored.  duplicate packets are checked via a
-// struct in the TFTP protocol struct
-func (c *TFTPProtocol) appendFileDate(data *tftp.Data) bool {
+// AppendFileDate appends the data of the next block to the file.  Blocks
+// are only accepted in order, so the file is built up in place and the
+// buffer the block was decrypted into can be reused for the next packet.
+// Anything but the next expected block is a duplicate and is discarded.
+func (c *TFTPProtocol) appendFileDate(block uint64, data *tftp.Data) bool {
 	// Check if the packet is already stored
-	if _, exists := c.receivedPackets[data.BlockNumber]; exists {
+	if block != c.nextSeqNum {
 		log.Println("Duplicate packet, discarding")
 		return false
 	}
-	c.receivedPackets[data.BlockNumber] = data
+	c.received = append(c.received, data.Data...)
 	c.totalFrames++
 	return true
 }
@@ -145,21 +288,9 @@ func (c *TFTPProtocol) Close() error {
 	return c.conn.Close()
 }
 
+// rebuildData returns the file received so far
 func (c *TFTPProtocol) rebuildData() []byte {
-	var data []byte
-	keys := make([]int, 0, len(c.receivedPackets))
-
-	// Get and sort the keys
-	for k := range c.receivedPackets {
-		keys = append(keys, int(k))
-	}
-	sort.Ints(keys)
-
-	// Rebuild the data using the sorted keys
-	for _, key := range keys {
-		data = append(data, c.receivedPackets[uint16(key)].Data...)
-	}
-	return data
+	return c.received
 }
 
 func (c *TFTPProtocol) StartTime() {
@@ -178,6 +309,8 @@ func (c *TFTPProtocol) DisplayStats(n int) {
 	log.Println("Total frames received:", c.totalFrames)
 	log.Println("Total bytes received:", c.dataThroughIn)
 	log.Println("Total bytes sent:", c.dataThroughOut)
+	log.Println("Round trip time:", c.rtt.stats())
+	log.Println("Congestion window:", c.cwnd.stats())
 	nanos := time.Duration(c.requestEnd - c.requestStart)
 	bytesToMegaBit := (float64(c.dataThroughIn+c.dataThroughOut) * 8) / 1000000
 	through := bytesToMegaBit / nanos.Seconds()
@@ -185,12 +318,13 @@ func (c *TFTPProtocol) DisplayStats(n int) {
 	log.Println("Perceived Throughput: ", float64(n*8/1000000)/nanos.Seconds(), "Mbps")
 }
 
-func PrepareData(data []byte, blockSize int, xorKey []byte) (dataQueue []*tftp.Data, err error) {
-	// Create a slice of TFTPData packets
-	blocks := len(data) / blockSize
-	if len(data)%blockSize != 0 {
-		blocks++
-	}
+// PrepareData splits data into DATA packets of blockSize bytes, numbering
+// them from 1 and rolling the block number over to rollover after 65535.
+func PrepareData(data []byte, blockSize int, rollover uint16, xorKey []byte) (dataQueue []*tftp.Data, err error) {
+	// Create a slice of TFTPData packets, a file that is an exact multiple
+	// of the block size ends with an empty block so the receiver can tell
+	// the transfer is complete
+	blocks := len(data)/blockSize + 1
 	log.Printf("Length of data: %d, Block size: %d, Blocks: %d", len(data), blockSize, blocks)
 	dataQueue = make([]*tftp.Data, blocks)
 
@@ -204,7 +338,7 @@ func PrepareData(data []byte, blockSize int, xorKey []byte) (dataQueue []*tftp.D
 		}
 		// Create the TFTPData packet
 		// data que append
-		dataQueue[i], err = tftp.NewData(uint16(i)+1, data[start:end], xorKey)
+		dataQueue[i], err = tftp.NewData(tftp.WireBlock(uint64(i)+1, rollover), data[start:end], xorKey)
 
 		if err != nil {
 			return
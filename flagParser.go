@@ -6,30 +6,89 @@ import (
 )
 
 var (
-	Address    string
-	Mode       string
-	Port       int
-	DropPax    bool
-	WindowSize int
+	Address           string
+	Mode              string
+	Listen            string
+	Port              int
+	DropPax           bool
+	WindowSize        int
+	BlockSize         int
+	Timeout           int
+	Retries           int
+	SelectiveRepeat   bool
+	TransferMode      string
+	ForbidPlaintext   bool
+	MaxSessions       int
+	MaxClientSessions int
+	IdleTimeout       int
+	DrainTimeout      int
+	Root              string
+	UploadDir         string
+	MaxUploadSize     int64
+	ConfigFile        string
+	LogFile           string
+	RequestRate       float64
+	ClientRequestRate float64
+	SendRate          float64
+	ClientSendRate    float64
+	RequireCookie     bool
 )
 
+// flagValues holds the settings as given on the command line, or their
+// defaults, before the config file is applied
+var flagValues = defaultSettings()
+
+// explicitFlags are the flags set on the command line, they win over the
+// config file
+var explicitFlags = make(map[string]bool)
+
 // parseProgramArguments parses the command line arguments and sets the global variables based on them
 // if configuration is valid the program will continue, otherwise it will exit with an error code
 // contains options for server, client, address, simulated packet drops.
+// Settings in the config file named by -Config apply unless the flag for
+// them is given as well.
 func parseProgramArguments() {
-	flag.StringVar(&Mode, "Mode", "", "Application mode: 'server' or client'.")
-	flag.StringVar(&Address, "Address", "", "Remote address to connect to while in Client mode, this field is ignored when set in server mode.")
-	flag.IntVar(&Port, "Port", 7500, "Port the application will listen to while in server mode.")
-	flag.BoolVar(&DropPax, "DropPax", false, "Simulate dropping packets while in server mode.")
-	flag.IntVar(&WindowSize, "WindowSize", 4, "Size of the sliding window while in server mode.")
+	s := &flagValues
+	flag.StringVar(&ConfigFile, "Config", "", "JSON config file, flags given on the command line override its settings.")
+	flag.StringVar(&s.Mode, "Mode", s.Mode, "Application mode: 'server' or 'client'.")
+	flag.StringVar(&s.Address, "Address", s.Address, "Remote address to connect to while in Client mode, this field is ignored when set in server mode.")
+	flag.StringVar(&s.Listen, "Listen", s.Listen, "IP address the server listens on, all interfaces when empty.")
+	flag.IntVar(&s.Port, "Port", s.Port, "Port the application will listen to while in server mode.")
+	flag.BoolVar(&s.DropPax, "DropPax", s.DropPax, "Simulate dropping packets while in server mode.")
+	flag.IntVar(&s.WindowSize, "WindowSize", s.WindowSize, "Sliding window size requested in client mode, largest window accepted in server mode.")
+	flag.IntVar(&s.BlockSize, "BlockSize", s.BlockSize, "Block size requested in client mode, largest block size accepted in server mode.")
+	flag.IntVar(&s.Timeout, "Timeout", s.Timeout, "Retransmission timeout in seconds requested in client mode.")
+	flag.IntVar(&s.Retries, "Retries", s.Retries, "Times an unacknowledged block is sent again before the transfer is given up on.")
+	flag.BoolVar(&s.SelectiveRepeat, "SelectiveRepeat", s.SelectiveRepeat, "Request Selective Repeat in client mode, only lost blocks are sent again instead of the whole window. Gaps are reported with SACKs when the server supports them.")
+	flag.StringVar(&s.TransferMode, "TransferMode", s.TransferMode, "Transfer mode requested in client mode: 'octet' or 'netascii'.")
+	flag.BoolVar(&s.ForbidPlaintext, "ForbidPlaintext", s.ForbidPlaintext, "Refuse plain RFC 1350 sessions without key exchange while in server mode.")
+	flag.IntVar(&s.MaxSessions, "MaxSessions", s.MaxSessions, "Transfers served at once in server mode, 0 for no limit.")
+	flag.IntVar(&s.MaxClientSessions, "MaxClientSessions", s.MaxClientSessions, "Transfers served at once to a single client address in server mode, 0 for no limit.")
+	flag.IntVar(&s.IdleTimeout, "IdleTimeout", s.IdleTimeout, "Seconds a transfer may go without hearing from the client before the server aborts it, 0 to never expire.")
+	flag.IntVar(&s.DrainTimeout, "DrainTimeout", s.DrainTimeout, "Seconds a shutting down server lets transfers finish before terminating them.")
+	flag.StringVar(&s.Root, "Root", s.Root, "Directory local files are served from in server mode, requests for URLs are proxied either way.")
+	flag.StringVar(&s.UploadDir, "UploadDir", s.UploadDir, "Directory uploads are stored in while in server mode, uploads are refused when empty.")
+	flag.Int64Var(&s.MaxUploadSize, "MaxUploadSize", s.MaxUploadSize, "Largest upload in bytes accepted in server mode, 0 for no limit.")
+	flag.Float64Var(&s.RequestRate, "RequestRate", s.RequestRate, "New requests per second accepted from all clients in server mode, 0 for no limit.")
+	flag.Float64Var(&s.ClientRequestRate, "ClientRequestRate", s.ClientRequestRate, "New requests per second accepted from a single client address in server mode, 0 for no limit.")
+	flag.Float64Var(&s.SendRate, "SendRate", s.SendRate, "Bytes per second sent to all clients in server mode, 0 for no limit.")
+	flag.Float64Var(&s.ClientSendRate, "ClientSendRate", s.ClientSendRate, "Bytes per second sent to a single client address in server mode, 0 for no limit.")
+	flag.BoolVar(&s.RequireCookie, "RequireCookie", s.RequireCookie, "Make clients echo a cookie sent to their address before the server does any work for their requests in server mode.")
+	flag.StringVar(&s.LogFile, "LogFile", s.LogFile, "File the log is appended to, standard error when empty.")
 	flag.Parse()
+	flag.Visit(func(f *flag.Flag) { explicitFlags[f.Name] = true })
 
-	if Mode == "server" && Address != "" {
-		log.Println("Warning: Address argument is ignored when application set to server mode.")
+	settings, err := loadSettings()
+	if err != nil {
+		log.Fatalf("Invalid configuration.  %s", err)
+	}
+	settings.apply()
+	if err = configureLogging(); err != nil {
+		log.Fatalf("Invalid configuration.  %s", err)
 	}
 
-	if Mode == "client" && Address == "" {
-		log.Fatalf("Invalid Address.  Address must be specified for client mode.")
+	if Mode == "server" && Address != "" {
+		log.Println("Warning: Address argument is ignored when application set to server mode.")
 	}
 
 	if DropPax && Mode == "client" {
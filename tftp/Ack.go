@@ -2,55 +2,61 @@ package tftp
 
 import (
 	"encoding/binary"
-
-	"errors"
+	"fmt"
 )
 
 // Ack represents a TFTP ACK packet.
 type Ack struct {
-	Opcode      TFTPOpcode
 	BlockNumber uint16
 }
 
 // NewAck method constructs a new Ack struct
 func NewAck(blockNumber uint16) *Ack {
 	return &Ack{
-		Opcode:      TFTPOpcodeACK,
 		BlockNumber: blockNumber,
 	}
 }
 
+// Opcode returns the ACK opcode
+func (ack *Ack) Opcode() TFTPOpcode {
+	return TFTPOpcodeACK
+}
+
 // Parse method parses a byte array into an Ack struct
 func (ack *Ack) Parse(packet []byte) error {
-	// Check that the packet is at least 4 bytes long
-	if len(packet) < 4 {
-		return errors.New("packet too short")
+	// Check the opcode and that the packet is exactly 4 bytes long
+	if err := checkHeader(packet, TFTPOpcodeACK, 4); err != nil {
+		return err
 	}
-
-	// Check that the opcode is valid
-	opcode := binary.BigEndian.Uint16(packet[:2])
-	if opcode != uint16(TFTPOpcodeACK) {
-		return errors.New("invalid opcode")
+	if len(packet) != 4 {
+		return fmt.Errorf("%w: ACK packet has %d trailing bytes", ErrMalformed, len(packet)-4)
 	}
 
 	// Parse the block number
 	blockNumber := binary.BigEndian.Uint16(packet[2:4])
 
 	// Set the fields in the Ack packet
-	ack.Opcode = TFTPOpcodeACK
 	ack.BlockNumber = blockNumber
 
 	return nil
 }
 
+// AppendTo appends the encoded Ack packet to b
+func (ack *Ack) AppendTo(b []byte) ([]byte, error) {
+	// Set the opcode and block number in the packet.
+	b = binary.BigEndian.AppendUint16(b, uint16(TFTPOpcodeACK))
+	b = binary.BigEndian.AppendUint16(b, ack.BlockNumber)
+	return b, nil
+}
+
+// MarshalBinary encodes the Ack packet into a new byte slice
+func (ack *Ack) MarshalBinary() ([]byte, error) {
+	return ack.AppendTo(make([]byte, 0, 4))
+}
+
 // ToBytes method converts the Ack struct to a byte array packet
 func (ack *Ack) ToBytes() []byte {
 	// Allocate a byte slice to hold the packet.
-	packet := make([]byte, 4)
-
-	// Set the opcode and block number in the packet.
-	binary.BigEndian.PutUint16(packet[:2], uint16(ack.Opcode))
-	binary.BigEndian.PutUint16(packet[2:4], ack.BlockNumber)
-
+	packet, _ := ack.AppendTo(make([]byte, 0, 4))
 	return packet
 }
@@ -2,38 +2,79 @@ package tftp
 
 import (
 	"encoding/binary"
-	"errors"
+	"fmt"
 	"hash/crc32"
 )
 
+// MaxBlockSize is the largest block a DATA packet may carry, RFC 2348
+const MaxBlockSize = 65464
+
 // Data struct represents a TFTP data packet
 type Data struct {
-	Opcode      TFTPOpcode
 	BlockNumber uint16
 	Checksum    uint32
 	Data        []byte
 }
 
-// ToBytes method converts the TFTPData struct to a byte array packet
-func (d *Data) ToBytes() []byte {
+// Opcode returns the DATA opcode
+func (d *Data) Opcode() TFTPOpcode {
+	return TFTPOpcodeDATA
+}
+
+// AppendTo appends the encoded data packet to b
+func (d *Data) AppendTo(b []byte) ([]byte, error) {
 	// Construct the data packet
-	packet := make([]byte, 2+2+4+len(d.Data))
-	binary.BigEndian.PutUint16(packet[:2], uint16(TFTPOpcodeDATA))
-	binary.BigEndian.PutUint16(packet[2:4], d.BlockNumber)
-	binary.BigEndian.PutUint32(packet[4:8], d.Checksum)
-	copy(packet[8:], d.Data)
+	b = binary.BigEndian.AppendUint16(b, uint16(TFTPOpcodeDATA))
+	b = binary.BigEndian.AppendUint16(b, d.BlockNumber)
+	b = binary.BigEndian.AppendUint32(b, d.Checksum)
+	return append(b, d.Data...), nil
+}
 
+// MarshalBinary encodes the data packet into a new byte slice
+func (d *Data) MarshalBinary() ([]byte, error) {
+	return d.AppendTo(make([]byte, 0, 2+2+4+len(d.Data)))
+}
+
+// ToBytes method converts the TFTPData struct to a byte array packet
+func (d *Data) ToBytes() []byte {
 	// Return the data packet
+	packet, _ := d.MarshalBinary()
 	return packet
-} //data = Xor(data, xorKey)
-//data = data
-// Calculate the checksum
+}
+
+// AppendPlainTo appends the data packet to b in plain RFC 1350 framing,
+// without the checksum field
+func (d *Data) AppendPlainTo(b []byte) ([]byte, error) {
+	b = binary.BigEndian.AppendUint16(b, uint16(TFTPOpcodeDATA))
+	b = binary.BigEndian.AppendUint16(b, d.BlockNumber)
+	return append(b, d.Data...), nil
+}
+
+// ParsePlain parses a data packet in plain RFC 1350 framing, computing the
+// checksum locally
+func (d *Data) ParsePlain(packet []byte) error {
+	// Check the opcode, the header and that the block fits the largest blksize
+	if err := checkHeader(packet, TFTPOpcodeDATA, 4); err != nil {
+		return err
+	}
+	if len(packet)-4 > MaxBlockSize {
+		return fmt.Errorf("%w: DATA block of %d bytes exceeds %d", ErrMalformed, len(packet)-4, MaxBlockSize)
+	}
+
+	d.BlockNumber = binary.BigEndian.Uint16(packet[2:4])
+	d.Data = packet[4:]
+	d.Checksum = crc32.ChecksumIEEE(d.Data)
+	return nil
+}
 
 // Parse method parses a byte array into a TFTPData struct
-func (d *Data) Parse(packet []byte, xorKey []byte) error {
-	// Check that the packet is at least 8 bytes long
-	if len(packet) < 8 {
-		return errors.New("packet too short")
+func (d *Data) Parse(packet []byte) error {
+	// Check the opcode, the header and that the block fits the largest blksize
+	if err := checkHeader(packet, TFTPOpcodeDATA, 8); err != nil {
+		return err
+	}
+	if len(packet)-8 > MaxBlockSize {
+		return fmt.Errorf("%w: DATA block of %d bytes exceeds %d", ErrMalformed, len(packet)-8, MaxBlockSize)
 	}
 
 	// Parse the block number, checksum, and data
@@ -41,7 +82,6 @@ func (d *Data) Parse(packet []byte, xorKey []byte) error {
 	checksum := binary.BigEndian.Uint32(packet[4:8])
 	data := packet[8:]
 
-	d.Opcode = TFTPOpcodeDATA
 	d.BlockNumber = blockNumber
 	d.Checksum = checksum
 	d.Data = data
@@ -51,16 +91,12 @@ func (d *Data) Parse(packet []byte, xorKey []byte) error {
 
 // NewData method constructs a new TFTPData struct
 func NewData(blockNumber uint16, data []byte, xorKey []byte) (*Data, error) {
-	// Check that the data is not empty
-	if len(data) == 0 {
-		return nil, errors.New("data is empty")
-	}
-
+	// An empty block is valid, it terminates a file that is an exact
+	// multiple of the block size
 	checksum := crc32.ChecksumIEEE(data)
 
 	// Construct and return the TFTPData struct
 	dataPacket := &Data{
-		Opcode:      TFTPOpcodeDATA,
 		BlockNumber: blockNumber,
 		Checksum:    checksum,
 		Data:        data,
@@ -11,6 +11,7 @@ const (
 	TFTPOpcodeOACK  TFTPOpcode = 6
 	__tftUnused     TFTPOpcode = 7
 	TFTPOpcodeTERM  TFTPOpcode = 8
+	TFTPOpcodeSACK  TFTPOpcode = 9
 )
 
 func (o TFTPOpcode) String() string {
@@ -27,6 +28,10 @@ func (o TFTPOpcode) String() string {
 		return "ERROR"
 	case TFTPOpcodeOACK:
 		return "OACK"
+	case TFTPOpcodeTERM:
+		return "TERM"
+	case TFTPOpcodeSACK:
+		return "SACK"
 	default:
 		return "INVALID"
 	}
@@ -1,59 +1,160 @@
 package tftp
 
 import (
+	"bytes"
 	"encoding/binary"
-	"errors"
+	"fmt"
 )
 
-// Error TFTPError represents a TFTP error packet.
+// ErrorCode is the error code carried by an ERROR packet
+type ErrorCode uint16
+
+// Error codes from RFC 1350 and RFC 2347, followed by this project's
+// extensions
+const (
+	CodeNotDefined        ErrorCode = 0
+	CodeFileNotFound      ErrorCode = 1
+	CodeAccessViolation   ErrorCode = 2
+	CodeDiskFull          ErrorCode = 3
+	CodeIllegalOperation  ErrorCode = 4
+	CodeUnknownTID        ErrorCode = 5
+	CodeFileExists        ErrorCode = 6
+	CodeNoSuchUser        ErrorCode = 7
+	CodeOptionNegotiation ErrorCode = 8
+
+	CodeTransferAborted ErrorCode = 9  // Transfer aborted by the peer
+	CodeKeyExchange     ErrorCode = 11 // ECDH key exchange failed
+	CodeMalformedPacket ErrorCode = 22 // Packet could not be parsed
+)
+
+// String returns a short description of the error code
+func (c ErrorCode) String() string {
+	switch c {
+	case CodeNotDefined:
+		return "not defined"
+	case CodeFileNotFound:
+		return "file not found"
+	case CodeAccessViolation:
+		return "access violation"
+	case CodeDiskFull:
+		return "disk full or allocation exceeded"
+	case CodeIllegalOperation:
+		return "illegal TFTP operation"
+	case CodeUnknownTID:
+		return "unknown transfer ID"
+	case CodeFileExists:
+		return "file already exists"
+	case CodeNoSuchUser:
+		return "no such user"
+	case CodeOptionNegotiation:
+		return "option negotiation failed"
+	case CodeTransferAborted:
+		return "transfer aborted"
+	case CodeKeyExchange:
+		return "key exchange failed"
+	case CodeMalformedPacket:
+		return "malformed packet"
+	default:
+		return fmt.Sprintf("error code %d", uint16(c))
+	}
+}
+
+// Sentinel errors for use with errors.Is, an *Error matches any of these
+// that carries the same error code
+var (
+	ErrNotDefined        = &Error{ErrorCode: CodeNotDefined}
+	ErrFileNotFound      = &Error{ErrorCode: CodeFileNotFound}
+	ErrAccessViolation   = &Error{ErrorCode: CodeAccessViolation}
+	ErrDiskFull          = &Error{ErrorCode: CodeDiskFull}
+	ErrIllegalOperation  = &Error{ErrorCode: CodeIllegalOperation}
+	ErrUnknownTID        = &Error{ErrorCode: CodeUnknownTID}
+	ErrFileExists        = &Error{ErrorCode: CodeFileExists}
+	ErrNoSuchUser        = &Error{ErrorCode: CodeNoSuchUser}
+	ErrOptionNegotiation = &Error{ErrorCode: CodeOptionNegotiation}
+	ErrTransferAborted   = &Error{ErrorCode: CodeTransferAborted}
+	ErrKeyExchange       = &Error{ErrorCode: CodeKeyExchange}
+	ErrMalformedPacket   = &Error{ErrorCode: CodeMalformedPacket}
+)
+
+// Error TFTPError represents a TFTP error packet.  It implements the error
+// interface so an ERROR received from a peer can be returned as is.
 type Error struct {
-	Opcode       TFTPOpcode
-	ErrorCode    uint16
+	ErrorCode    ErrorCode
 	ErrorMessage []byte
 }
 
 // NewErr creates a new TFTP error packet.
-func NewErr(errorCode uint16, errorMessage []byte) *Error {
+func NewErr(errorCode ErrorCode, errorMessage []byte) *Error {
 	return &Error{
-		Opcode:       TFTPOpcodeERROR,
 		ErrorCode:    errorCode,
 		ErrorMessage: errorMessage,
 	}
 }
 
+// Error returns the error code and message of the packet
+func (err *Error) Error() string {
+	if len(err.ErrorMessage) == 0 {
+		return "tftp: " + err.ErrorCode.String()
+	}
+	return fmt.Sprintf("tftp: %s: %s", err.ErrorCode, err.ErrorMessage)
+}
+
+// Is reports whether target is an *Error with the same error code
+func (err *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.ErrorCode == err.ErrorCode
+}
+
+// Opcode returns the ERROR opcode
+func (err *Error) Opcode() TFTPOpcode {
+	return TFTPOpcodeERROR
+}
+
+// AppendTo appends the encoded error packet to b.
+func (err *Error) AppendTo(b []byte) ([]byte, error) {
+	// Set the opcode and error code in the packet.
+	b = binary.BigEndian.AppendUint16(b, uint16(TFTPOpcodeERROR))
+	b = binary.BigEndian.AppendUint16(b, uint16(err.ErrorCode))
+	// Copy the error message into the packet, NUL terminated as in RFC 1350.
+	if bytes.IndexByte(err.ErrorMessage, 0) >= 0 {
+		return nil, fmt.Errorf("%w: ERROR message contains a NUL byte", ErrMalformed)
+	}
+	b = append(b, err.ErrorMessage...)
+	return append(b, 0), nil
+}
+
+// MarshalBinary encodes the error packet into a new byte slice.
+func (err *Error) MarshalBinary() ([]byte, error) {
+	return err.AppendTo(make([]byte, 0, 4+len(err.ErrorMessage)+1))
+}
+
 // ToBytes converts the error packet to a byte slice.
 func (err *Error) ToBytes() []byte {
-	// Allocate a byte slice to hold the packet.
-	packet := make([]byte, 4+len(err.ErrorMessage))
-	// Set the opcode and error code in the packet.
-	binary.BigEndian.PutUint16(packet[:2], uint16(err.Opcode))
-	binary.BigEndian.PutUint16(packet[2:4], err.ErrorCode)
-	// Copy the error message into the packet.
-	copy(packet[4:], err.ErrorMessage)
+	packet, _ := err.MarshalBinary()
 	return packet
 }
 
 // Parse parses a TFTP error packet.
 func (err *Error) Parse(packet []byte) error {
-	// Check that the packet is at least 5 bytes long
-	if len(packet) < 5 {
-		return errors.New("packet too short")
-	}
-
-	// Check that the opcode is valid
-	opcode := binary.BigEndian.Uint16(packet[:2])
-	if opcode != uint16(TFTPOpcodeERROR) {
-		return errors.New("invalid opcode")
+	// Check the opcode and that there is room for the code and terminator
+	if err := checkHeader(packet, TFTPOpcodeERROR, 5); err != nil {
+		return err
 	}
 	// Parse the error code
 	errorCode := binary.BigEndian.Uint16(packet[2:4])
 
-	// Parse the error message
+	// Parse the error message, a single NUL terminated string
 	errorMessage := packet[4:]
+	if errorMessage[len(errorMessage)-1] != 0 {
+		return fmt.Errorf("%w: ERROR message is not NUL terminated", ErrMalformed)
+	}
+	errorMessage = errorMessage[:len(errorMessage)-1]
+	if bytes.IndexByte(errorMessage, 0) >= 0 {
+		return fmt.Errorf("%w: ERROR message contains a NUL byte", ErrMalformed)
+	}
 
 	// Set the fields in the error packet
-	err.Opcode = TFTPOpcodeERROR
-	err.ErrorCode = errorCode
+	err.ErrorCode = ErrorCode(errorCode)
 	err.ErrorMessage = errorMessage
 
 	return nil
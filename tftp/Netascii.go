@@ -0,0 +1,89 @@
+package tftp
+
+import (
+	"bytes"
+	"strings"
+)
+
+// Transfer modes from RFC 1350
+const (
+	ModeNetascii = "netascii"
+	ModeOctet    = "octet"
+	ModeMail     = "mail"
+)
+
+// NormalizeMode returns the lower case form of a transfer mode, modes are
+// case insensitive on the wire
+func NormalizeMode(mode []byte) string {
+	return strings.ToLower(string(mode))
+}
+
+// AppendNetascii appends src translated to netascii to dst.  Every LF becomes
+// CR LF and every bare CR becomes CR NUL as required by RFC 1350.  Each byte
+// is translated on its own so the input may be split at any point.
+func AppendNetascii(dst, src []byte) []byte {
+	for _, c := range src {
+		switch c {
+		case '\n':
+			dst = append(dst, '\r', '\n')
+		case '\r':
+			dst = append(dst, '\r', 0)
+		default:
+			dst = append(dst, c)
+		}
+	}
+	return dst
+}
+
+// ToNetascii returns src translated to netascii
+func ToNetascii(src []byte) []byte {
+	return AppendNetascii(make([]byte, 0, len(src)+bytes.Count(src, []byte{'\n'})), src)
+}
+
+// NetasciiDecoder translates netascii back to local text.  It holds on to a
+// trailing CR between calls so a CR LF or CR NUL pair split across two
+// blocks still decodes correctly.
+type NetasciiDecoder struct {
+	pendingCR bool
+}
+
+// AppendDecode appends src translated from netascii to dst
+func (d *NetasciiDecoder) AppendDecode(dst, src []byte) []byte {
+	for _, c := range src {
+		if d.pendingCR {
+			d.pendingCR = false
+			switch c {
+			case '\n':
+				dst = append(dst, '\n')
+				continue
+			case 0:
+				dst = append(dst, '\r')
+				continue
+			default:
+				// A CR that is not part of a pair is kept as is
+				dst = append(dst, '\r')
+			}
+		}
+		if c == '\r' {
+			d.pendingCR = true
+			continue
+		}
+		dst = append(dst, c)
+	}
+	return dst
+}
+
+// Flush appends a CR still held back at the end of the input to dst
+func (d *NetasciiDecoder) Flush(dst []byte) []byte {
+	if d.pendingCR {
+		d.pendingCR = false
+		dst = append(dst, '\r')
+	}
+	return dst
+}
+
+// FromNetascii returns src translated from netascii
+func FromNetascii(src []byte) []byte {
+	var d NetasciiDecoder
+	return d.Flush(d.AppendDecode(make([]byte, 0, len(src)), src))
+}
@@ -1,121 +1,125 @@
 package tftp
 
 import (
-	"bytes"
 	"encoding/binary"
-	"errors"
-	"strconv"
-	"strings"
+	"fmt"
 )
 
 type OptionAcknowledgement struct {
-	Opcode     TFTPOpcode
 	Windowsize uint16
 	XferSize   uint32
 	BlkSize    uint16
 	Timeout    uint16
 	Key        []byte
 	KeyX, KeyY []byte
+	Extensions Options // Registered options without a field of their own
 }
 
-func New(opcode TFTPOpcode) *OptionAcknowledgement {
-	return &OptionAcknowledgement{
-		Opcode: opcode,
-	}
+func NewOack() *OptionAcknowledgement {
+	return &OptionAcknowledgement{}
+}
+
+// Opcode returns the OACK opcode
+func (oa *OptionAcknowledgement) Opcode() TFTPOpcode {
+	return TFTPOpcodeOACK
 }
 
 func (oa *OptionAcknowledgement) Parse(data []byte) error {
-	if len(data) < 2 {
-		return errors.New("invalid data length")
+	// An OACK acknowledges at least one option, RFC 2347
+	if err := checkHeader(data, TFTPOpcodeOACK, 2); err != nil {
+		return err
+	}
+	fields, err := splitFields(data[2:])
+	if err != nil {
+		return err
+	}
+	if len(fields) == 0 {
+		return fmt.Errorf("%w: OACK carries no options", ErrMalformed)
+	}
+
+	// Decode the options through the registry, unknown options are dropped
+	options, err := parseOptions(fields)
+	if err != nil {
+		return err
+	}
+
+	*oa = OptionAcknowledgement{}
+	if v, ok := options.Uint("windowsize"); ok {
+		oa.Windowsize = uint16(v)
+	}
+	if v, ok := options.Uint("tsize"); ok {
+		oa.XferSize = uint32(v)
+	}
+	if v, ok := options.Uint("blksize"); ok {
+		oa.BlkSize = uint16(v)
+	}
+	if v, ok := options.Uint("timeout"); ok {
+		oa.Timeout = uint16(v)
 	}
+	oa.Key = options["key"]
+	oa.KeyX = options["keyx"]
+	oa.KeyY = options["keyy"]
 
-	oa.Opcode = TFTPOpcode(binary.BigEndian.Uint16(data[:2]))
-	options := strings.Split(string(data[2:]), "\x00")
+	// Anything left over is kept for the caller to look up by name
+	for _, name := range []string{"windowsize", "tsize", "blksize", "timeout", "key", "keyx", "keyy"} {
+		delete(options, name)
+	}
+	if len(options) > 0 {
+		oa.Extensions = options
+	}
 
-	for i := 0; i < len(options)-1; i += 2 {
-		switch options[i] {
-		case "windowsize":
-			val, _ := strconv.ParseUint(options[i+1], 10, 16)
-			oa.Windowsize = uint16(val)
-		case "tsize":
-			val, _ := strconv.ParseUint(options[i+1], 10, 32)
-			oa.XferSize = uint32(val)
-		case "blksize":
-			val, _ := strconv.ParseUint(options[i+1], 10, 16)
-			oa.BlkSize = uint16(val)
-		case "timeout":
-			val, _ := strconv.ParseUint(options[i+1], 10, 16)
-			oa.Timeout = uint16(val)
-		case "key":
-			oa.Key = []byte(options[i+1])
-		case "keyx":
-			oa.KeyX = []byte(options[i+1])
-		case "keyy":
-			oa.KeyY = []byte(options[i+1])
-		}
+	// An answer that acknowledges nothing we know of is no answer at all
+	if len(oa.Options()) == 0 {
+		return fmt.Errorf("%w: OACK acknowledges no known option", ErrMalformed)
 	}
 
 	return nil
 }
 
-func (oa *OptionAcknowledgement) ToBytes() []byte {
-	buf := new(bytes.Buffer)
-	// Write Opcode
-	binary.Write(buf, binary.BigEndian, oa.Opcode)
-	// Write WindowSize
+// Options returns the acknowledged options, zero values are left out
+func (oa *OptionAcknowledgement) Options() Options {
+	options := make(Options)
+	for name, value := range oa.Extensions {
+		options[name] = value
+	}
 	if oa.Windowsize > 0 {
-		buf.WriteString("windowsize")
-		buf.WriteByte(0)
-		buf.WriteString(strconv.Itoa(int(oa.Windowsize)))
-		buf.WriteByte(0)
+		options.SetUint("windowsize", uint64(oa.Windowsize))
 	}
-
-	// Write XferSize
 	if oa.XferSize > 0 {
-		buf.WriteString("tsize")
-		buf.WriteByte(0)
-		buf.WriteString(strconv.Itoa(int(oa.XferSize)))
-		buf.WriteByte(0)
+		options.SetUint("tsize", uint64(oa.XferSize))
 	}
-
-	// Write BlkSize
 	if oa.BlkSize > 0 {
-		buf.WriteString("blksize")
-		buf.WriteByte(0)
-		buf.WriteString(strconv.Itoa(int(oa.BlkSize)))
-		buf.WriteByte(0)
+		options.SetUint("blksize", uint64(oa.BlkSize))
 	}
-
-	// Write Timeout
 	if oa.Timeout > 0 {
-		buf.WriteString("timeout")
-		buf.WriteByte(0)
-		buf.WriteString(strconv.Itoa(int(oa.Timeout)))
-		buf.WriteByte(0)
+		options.SetUint("timeout", uint64(oa.Timeout))
 	}
-
-	// Write key
 	if len(oa.Key) > 0 {
-		buf.WriteString("key")
-		buf.WriteByte(0)
-		buf.Write(oa.Key)
-		buf.WriteByte(0)
+		options["key"] = oa.Key
 	}
-
-	// Write keyx
 	if len(oa.KeyX) > 0 {
-		buf.WriteString("keyx")
-		buf.WriteByte(0)
-		buf.Write(oa.KeyX)
-		buf.WriteByte(0)
+		options["keyx"] = oa.KeyX
 	}
-
-	// Write keyy
 	if len(oa.KeyY) > 0 {
-		buf.WriteString("keyy")
-		buf.WriteByte(0)
-		buf.Write(oa.KeyY)
-		buf.WriteByte(0)
+		options["keyy"] = oa.KeyY
 	}
-	return buf.Bytes()
+	return options
+}
+
+// AppendTo appends the encoded OACK packet to b
+func (oa *OptionAcknowledgement) AppendTo(b []byte) ([]byte, error) {
+	// Write Opcode
+	b = binary.BigEndian.AppendUint16(b, uint16(TFTPOpcodeOACK))
+	// Write the options through the registry
+	return appendOptions(b, oa.Options())
+}
+
+// MarshalBinary encodes the OACK packet into a new byte slice
+func (oa *OptionAcknowledgement) MarshalBinary() ([]byte, error) {
+	return oa.AppendTo(nil)
+}
+
+func (oa *OptionAcknowledgement) ToBytes() []byte {
+	packet, _ := oa.AppendTo(nil)
+	return packet
 }
@@ -0,0 +1,143 @@
+package tftp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// ErrShortPacket is returned when a datagram is too short to hold an opcode
+var ErrShortPacket = errors.New("packet too short")
+
+// ErrMalformed is wrapped by every parse error that describes a packet
+// violating the wire format
+var ErrMalformed = errors.New("malformed packet")
+
+// ErrUnknownOpcode is returned when a datagram carries an opcode this package
+// does not know how to decode
+var ErrUnknownOpcode = errors.New("unknown opcode")
+
+// Packet is implemented by every TFTP packet type in this package so callers
+// can decode a datagram once and type switch on the result.
+type Packet interface {
+	// Opcode returns the opcode the packet is sent with
+	Opcode() TFTPOpcode
+	// MarshalBinary encodes the packet into a newly allocated byte slice
+	MarshalBinary() ([]byte, error)
+	// AppendTo appends the encoded packet to b and returns the extended slice
+	AppendTo(b []byte) ([]byte, error)
+	// Parse decodes a datagram into the packet, overwriting its fields
+	Parse(packet []byte) error
+}
+
+// Decode reads the opcode of a datagram and parses it into the matching
+// packet type.  Unknown opcodes and malformed packets are rejected here so
+// callers only ever see fully parsed packets.
+func Decode(packet []byte) (Packet, error) {
+	if len(packet) < 2 {
+		return nil, ErrShortPacket
+	}
+
+	var p Packet
+	switch opcode := TFTPOpcode(binary.BigEndian.Uint16(packet[:2])); opcode {
+	case TFTPOpcodeRRQ, TFTPOpcodeWRQ:
+		p = new(Request)
+	case TFTPOpcodeDATA:
+		p = new(Data)
+	case TFTPOpcodeACK:
+		p = new(Ack)
+	case TFTPOpcodeERROR:
+		p = new(Error)
+	case TFTPOpcodeOACK:
+		p = new(OptionAcknowledgement)
+	case TFTPOpcodeTERM:
+		p = new(Term)
+	case TFTPOpcodeSACK:
+		p = new(Sack)
+	default:
+		return nil, fmt.Errorf("%w: %d", ErrUnknownOpcode, uint16(opcode))
+	}
+	return parse(p, packet)
+}
+
+// Decoder decodes datagrams into packets it owns, so a transfer loop that
+// decodes one datagram at a time allocates nothing.  The packet returned by
+// Decode is overwritten by the next call and its slices share the
+// datagram's storage, callers copy anything they want to keep.
+type Decoder struct {
+	Plain bool // DATA packets use the plain RFC 1350 framing without a checksum
+
+	request Request
+	data    Data
+	ack     Ack
+	err     Error
+	oack    OptionAcknowledgement
+	term    Term
+	sack    Sack
+}
+
+// Decode works like the package level Decode but reuses the decoder's
+// packets
+func (d *Decoder) Decode(packet []byte) (Packet, error) {
+	if len(packet) < 2 {
+		return nil, ErrShortPacket
+	}
+
+	var p Packet
+	switch opcode := TFTPOpcode(binary.BigEndian.Uint16(packet[:2])); opcode {
+	case TFTPOpcodeRRQ, TFTPOpcodeWRQ:
+		d.request = Request{}
+		p = &d.request
+	case TFTPOpcodeDATA:
+		d.data = Data{}
+		if d.Plain {
+			if err := d.data.ParsePlain(packet); err != nil {
+				return nil, fmt.Errorf("decoding %s packet: %w", opcode, err)
+			}
+			return &d.data, nil
+		}
+		p = &d.data
+	case TFTPOpcodeACK:
+		d.ack = Ack{}
+		p = &d.ack
+	case TFTPOpcodeERROR:
+		d.err = Error{}
+		p = &d.err
+	case TFTPOpcodeOACK:
+		d.oack = OptionAcknowledgement{}
+		p = &d.oack
+	case TFTPOpcodeTERM:
+		d.term = Term{}
+		p = &d.term
+	case TFTPOpcodeSACK:
+		d.sack = Sack{Ranges: d.sack.Ranges[:0]} // Keep the ranges' storage
+		p = &d.sack
+	default:
+		return nil, fmt.Errorf("%w: %d", ErrUnknownOpcode, uint16(opcode))
+	}
+	return parse(p, packet)
+}
+
+// parse runs the packet's own parser, every parser checks its own length,
+// opcode and field layout
+func parse(p Packet, packet []byte) (Packet, error) {
+	if err := p.Parse(packet); err != nil {
+		return nil, fmt.Errorf("decoding %s packet: %w", p.Opcode(), err)
+	}
+	return p, nil
+}
+
+// checkHeader verifies a packet is at least min bytes long and carries the
+// expected opcode
+func checkHeader(packet []byte, opcode TFTPOpcode, min int) error {
+	if len(packet) < 2 {
+		return ErrShortPacket
+	}
+	if got := TFTPOpcode(binary.BigEndian.Uint16(packet[:2])); got != opcode {
+		return fmt.Errorf("%w: expected %s opcode, got %d", ErrMalformed, opcode, uint16(got))
+	}
+	if len(packet) < min {
+		return fmt.Errorf("%w: %s packet is %d bytes, need at least %d", ErrShortPacket, opcode, len(packet), min)
+	}
+	return nil
+}
@@ -0,0 +1,494 @@
+package tftp
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+// rounds is how many random packets each property test checks
+const rounds = 200
+
+// TestRequest checks that RRQ and WRQ packets with random options round trip
+func TestRequest(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	each(t, func() error {
+		op := TFTPOpcodeRRQ
+		if rng.Intn(2) == 0 {
+			op = TFTPOpcodeWRQ
+		}
+		modes := []string{ModeNetascii, ModeOctet, ModeMail}
+		req := &Request{
+			Op:       op,
+			Filename: randomText(rng, 1+rng.Intn(200)),
+			Mode:     []byte(modes[rng.Intn(len(modes))]),
+			Options:  randomOptions(rng),
+		}
+		return roundTrip(req)
+	})
+}
+
+// TestData checks that DATA packets of every size up to the largest blksize
+// round trip with their checksum intact
+func TestData(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	each(t, func() error {
+		block := make([]byte, rng.Intn(MaxBlockSize+1))
+		rng.Read(block)
+		d, err := NewData(uint16(rng.Intn(1<<16)), block, nil)
+		if err != nil {
+			return err
+		}
+		if err = roundTrip(d); err != nil {
+			return err
+		}
+		plain, _ := d.AppendPlainTo(nil)
+		var p Data
+		if err = p.ParsePlain(plain); err != nil {
+			return fmt.Errorf("plain DATA: %w", err)
+		}
+		if !reflect.DeepEqual(&p, d) {
+			return fmt.Errorf("plain DATA block %d did not round trip", d.BlockNumber)
+		}
+		return nil
+	})
+}
+
+// TestAck checks that ACK packets round trip for every block number
+func TestAck(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	each(t, func() error {
+		return roundTrip(NewAck(uint16(rng.Intn(1 << 16))))
+	})
+}
+
+// TestErrorPacket checks that ERROR packets round trip with their message
+func TestErrorPacket(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	each(t, func() error {
+		return roundTrip(NewErr(ErrorCode(rng.Intn(1<<16)), randomText(rng, rng.Intn(100))))
+	})
+}
+
+// TestOack checks that OACK packets round trip, including binary key material
+// containing NUL bytes
+func TestOack(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	each(t, func() error {
+		oa := &OptionAcknowledgement{
+			Windowsize: uint16(1 + rng.Intn(65535)),
+			XferSize:   rng.Uint32(),
+			BlkSize:    uint16(8 + rng.Intn(65464-7)),
+			Timeout:    uint16(1 + rng.Intn(255)),
+			KeyX:       randomBytes(rng, 1+rng.Intn(66)),
+			KeyY:       randomBytes(rng, 1+rng.Intn(66)),
+		}
+		if rng.Intn(2) == 0 {
+			oa.Extensions = Options{}
+			oa.Extensions.SetUint("rollover", uint64(rng.Intn(2)))
+		}
+		return roundTrip(oa)
+	})
+}
+
+// TestTerm checks that TERM packets and their acknowledgements round trip
+func TestTerm(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	each(t, func() error {
+		term := &Term{Reason: TermReason(rng.Intn(1 << 16)), Ack: rng.Intn(2) == 0}
+		return roundTrip(term)
+	})
+}
+
+// TestSack checks that SACK packets with up to MaxSackRanges ranges round trip
+func TestSack(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	each(t, func() error {
+		return roundTrip(randomSack(rng))
+	})
+}
+
+// TestMalformed checks that truncated and corrupted packets never panic the
+// decoder, and that truncated ACK, ERROR and TERM packets are always rejected
+func TestMalformed(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	each(t, func() error {
+		req := &Request{Op: TFTPOpcodeRRQ, Filename: []byte("file"), Mode: []byte(ModeOctet), Options: randomOptions(rng)}
+		fixed := [][]byte{mustMarshal(NewAck(1)), mustMarshal(NewErr(CodeFileNotFound, []byte("missing"))), mustMarshal(NewTermAck(TermShutdown))}
+		for i, packet := range append(fixed, mustMarshal(req)) {
+			for n := 0; n < len(packet); n++ {
+				accepted, err := tryDecode(packet[:n])
+				if err != nil {
+					return err
+				}
+				if accepted && i < len(fixed) {
+					return fmt.Errorf("truncated packet % x was accepted", packet[:n])
+				}
+			}
+			corrupt := append([]byte(nil), packet...)
+			corrupt[rng.Intn(len(corrupt))] = byte(rng.Intn(256))
+			if _, err := tryDecode(corrupt); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// TestDecoder checks that a Decoder reused across packets of every type decodes
+// each one exactly like Decode, with nothing left over from the packet
+// before it
+func TestDecoder(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	var d Decoder
+	each(t, func() error {
+		packets := []Packet{
+			&Request{Op: TFTPOpcodeRRQ, Filename: randomText(rng, 1+rng.Intn(20)), Mode: []byte(ModeOctet), Options: randomOptions(rng)},
+			&Data{BlockNumber: uint16(rng.Intn(1 << 16)), Data: randomBytes(rng, rng.Intn(64))},
+			NewAck(uint16(rng.Intn(1 << 16))),
+			NewErr(ErrorCode(rng.Intn(12)), randomText(rng, rng.Intn(20))),
+			&OptionAcknowledgement{BlkSize: uint16(8 + rng.Intn(1000)), KeyX: randomBytes(rng, 1+rng.Intn(66))},
+			NewTerm(TermReason(rng.Intn(5))),
+			randomSack(rng),
+		}
+		for _, i := range rng.Perm(len(packets)) {
+			encoded := mustMarshal(packets[i])
+			want, err := Decode(encoded)
+			if err != nil {
+				return err
+			}
+			got, err := d.Decode(encoded)
+			if err != nil {
+				return fmt.Errorf("Decoder: %w", err)
+			}
+			if !reflect.DeepEqual(normalize(got), normalize(want)) {
+				return fmt.Errorf("Decoder decoded %+v, Decode %+v", got, want)
+			}
+		}
+		return nil
+	})
+}
+
+// TestNetascii checks the netascii translation of local text and back, with
+// the translated text split into two blocks at every point
+func TestNetascii(t *testing.T) {
+	tests := []struct {
+		name        string
+		local, wire string
+	}{
+		{"empty", "", ""},
+		{"no line ends", "abc", "abc"},
+		{"LF", "a\nb\n", "a\r\nb\r\n"},
+		{"bare CR", "a\rb", "a\r\x00b"},
+		{"CR LF", "a\r\nb", "a\r\x00\r\nb"},
+		{"CR CR", "\r\r", "\r\x00\r\x00"},
+		{"trailing CR", "a\r", "a\r\x00"},
+		{"NUL", "a\x00b", "a\x00b"},
+	}
+	for _, tt := range tests {
+		if got := string(AppendNetascii([]byte("x"), []byte(tt.local))); got != "x"+tt.wire {
+			t.Errorf("%s: AppendNetascii gave %q, want %q", tt.name, got, "x"+tt.wire)
+		}
+		if got := string(ToNetascii([]byte(tt.local))); got != tt.wire {
+			t.Errorf("%s: ToNetascii gave %q, want %q", tt.name, got, tt.wire)
+		}
+		if got := string(FromNetascii([]byte(tt.wire))); got != tt.local {
+			t.Errorf("%s: FromNetascii gave %q, want %q", tt.name, got, tt.local)
+		}
+		for i := 0; i <= len(tt.wire); i++ {
+			if got := decodeSplit(tt.wire, i); got != tt.local {
+				t.Errorf("%s: split at %d decoded to %q, want %q", tt.name, i, got, tt.local)
+			}
+		}
+	}
+}
+
+// TestNetasciiDecoder checks netascii from a peer, including sequences our
+// translation never produces, split into two blocks at every point
+func TestNetasciiDecoder(t *testing.T) {
+	tests := []struct {
+		name        string
+		wire, local string
+	}{
+		{"CR NUL across blocks", "ab\r\x00cd", "ab\rcd"},
+		{"CR LF across blocks", "ab\r\ncd", "ab\ncd"},
+		{"CR CR LF", "\r\r\n", "\r\n"},
+		{"CR CR NUL", "\r\r\x00", "\r\r"},
+		{"lone CR before text", "a\rb", "a\rb"},
+		{"lone CR at EOF", "ab\r", "ab\r"},
+		{"only CR", "\r", "\r"},
+	}
+	for _, tt := range tests {
+		if got := string(FromNetascii([]byte(tt.wire))); got != tt.local {
+			t.Errorf("%s: FromNetascii gave %q, want %q", tt.name, got, tt.local)
+		}
+		for i := 0; i <= len(tt.wire); i++ {
+			if got := decodeSplit(tt.wire, i); got != tt.local {
+				t.Errorf("%s: split at %d decoded to %q, want %q", tt.name, i, got, tt.local)
+			}
+		}
+	}
+
+	// A CR at the end of a block is held back until the next block or Flush
+	var d NetasciiDecoder
+	if got := string(d.AppendDecode(nil, []byte("ab\r"))); got != "ab" {
+		t.Errorf("block ending in CR decoded to %q before the next block, want %q", got, "ab")
+	}
+	if got := string(d.Flush(nil)); got != "\r" {
+		t.Errorf("Flush gave %q, want the held back CR", got)
+	}
+	if got := string(d.Flush(nil)); got != "" {
+		t.Errorf("second Flush gave %q, want nothing", got)
+	}
+}
+
+// decodeSplit decodes wire in two blocks split at i with one decoder
+func decodeSplit(wire string, i int) string {
+	var d NetasciiDecoder
+	out := d.AppendDecode(nil, []byte(wire[:i]))
+	out = d.AppendDecode(out, []byte(wire[i:]))
+	return string(d.Flush(out))
+}
+
+// TestWireBlock checks the block numbers sent on the wire around the
+// rollover to 0 and to 1
+func TestWireBlock(t *testing.T) {
+	tests := []struct {
+		n        uint64
+		rollover uint16
+		want     uint16
+	}{
+		{0, 0, 0},
+		{1, 1, 1},
+		{MaxBlocks, 0, 65535},
+		{MaxBlocks, 1, 65535},
+		{MaxBlocks + 1, 0, 0},
+		{MaxBlocks + 1, 1, 1},
+		{MaxBlocks + 2, 0, 1},
+		{MaxBlocks + 2, 1, 2},
+		{2 * (MaxBlocks + 1), 0, 0},       // Second wrap to 0
+		{MaxBlocks + 1 + 65534, 1, 65535}, // Last block of the first period after rolling to 1
+		{MaxBlocks + 1 + 65535, 1, 1},     // Second wrap to 1
+	}
+	for _, tt := range tests {
+		if got := WireBlock(tt.n, tt.rollover); got != tt.want {
+			t.Errorf("WireBlock(%d, %d) = %d, want %d", tt.n, tt.rollover, got, tt.want)
+		}
+	}
+}
+
+// TestAbsoluteBlock checks wire block numbers unwrap to the block closest
+// to the one expected across the rollover
+func TestAbsoluteBlock(t *testing.T) {
+	tests := []struct {
+		name     string
+		wire     uint16
+		ref      uint64
+		rollover uint16
+		want     uint64
+	}{
+		{"first block", 1, 1, 0, 1},
+		{"ACK 0 before any data", 0, 1, 1, 0},
+		{"wrap to 0", 0, MaxBlocks, 0, MaxBlocks + 1},
+		{"wrap to 1", 1, MaxBlocks, 1, MaxBlocks + 1},
+		{"wire 0 after a wrap to 0", 0, MaxBlocks + 3, 0, MaxBlocks + 1},
+		{"wire 0 after a wrap to 1 is the old ACK 0", 0, MaxBlocks + 3, 1, 0},
+		{"small wire number expecting 65534", 3, MaxBlocks - 1, 0, MaxBlocks + 4},
+		{"small wire number expecting 65535, rollover 1", 3, MaxBlocks, 1, MaxBlocks + 3},
+		{"stale duplicate before the wrap", 65530, MaxBlocks + 5, 0, 65530},
+		{"stale duplicate before the wrap, rollover 1", 65530, MaxBlocks + 5, 1, 65530},
+		{"stale duplicate from the previous cycle", 65533, 2*(MaxBlocks+1) + 3, 0, MaxBlocks + 1 + 65533},
+		{"stale duplicate from the previous cycle, rollover 1", 65534, MaxBlocks + 1 + 65536, 1, MaxBlocks + 1 + 65533},
+	}
+	for _, tt := range tests {
+		if got := AbsoluteBlock(tt.wire, tt.ref, tt.rollover); got != tt.want {
+			t.Errorf("%s: AbsoluteBlock(%d, %d, %d) = %d, want %d", tt.name, tt.wire, tt.ref, tt.rollover, got, tt.want)
+		}
+	}
+
+	// Every block near a wrap unwraps from its wire number whichever block
+	// within a window of it is expected
+	for _, rollover := range []uint16{0, 1} {
+		for _, wrap := range []uint64{MaxBlocks + 1, MaxBlocks + 1 + 65536 - uint64(rollover)} {
+			for n := wrap - 100; n < wrap+100; n++ {
+				for _, ref := range []uint64{n - 64, n - 1, n, n + 1, n + 64} {
+					if got := AbsoluteBlock(WireBlock(n, rollover), ref, rollover); got != n {
+						t.Fatalf("block %d, rollover %d, expecting %d: unwrapped to %d", n, rollover, ref, got)
+					}
+				}
+			}
+		}
+	}
+}
+
+// FuzzDecode decodes random datagrams and checks that every packet that
+// decodes encodes and decodes to the same bytes again
+func FuzzDecode(f *testing.F) {
+	rng := rand.New(rand.NewSource(1))
+	seeds := []Packet{
+		&Request{Op: TFTPOpcodeRRQ, Filename: []byte("file"), Mode: []byte(ModeOctet), Options: randomOptions(rng)},
+		&Request{Op: TFTPOpcodeWRQ, Filename: []byte("upload"), Mode: []byte(ModeNetascii)},
+		&Data{BlockNumber: 1, Data: []byte("block")},
+		NewAck(1),
+		NewErr(CodeFileNotFound, []byte("missing")),
+		&OptionAcknowledgement{BlkSize: 1024, Windowsize: 8, KeyX: randomBytes(rng, 32)},
+		NewTermAck(TermShutdown),
+		randomSack(rng),
+	}
+	for _, p := range seeds {
+		f.Add(mustMarshal(p))
+	}
+	f.Add([]byte{})
+	f.Add([]byte{0, 4})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		p, err := Decode(data)
+		if err != nil {
+			return
+		}
+		encoded, err := p.MarshalBinary()
+		if err != nil {
+			t.Fatalf("decoded %s packet does not encode: %s", p.Opcode(), err)
+		}
+		again, err := Decode(encoded)
+		if err != nil {
+			t.Fatalf("encoded %s packet does not decode: %s", p.Opcode(), err)
+		}
+		reencoded, _ := again.MarshalBinary()
+		if !bytes.Equal(encoded, reencoded) {
+			t.Fatalf("%s packet does not round trip: % x != % x", p.Opcode(), encoded, reencoded)
+		}
+	})
+}
+
+// each runs check for every round and fails the test on its first error
+func each(t *testing.T, check func() error) {
+	t.Helper()
+	for i := 0; i < rounds; i++ {
+		if err := check(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// roundTrip encodes p, decodes it again and compares the two packets
+func roundTrip(p Packet) error {
+	encoded, err := p.MarshalBinary()
+	if err != nil {
+		return fmt.Errorf("encoding %s: %w", p.Opcode(), err)
+	}
+	appended, _ := p.AppendTo([]byte{0xff})
+	if !bytes.Equal(appended[1:], encoded) {
+		return fmt.Errorf("%s AppendTo and MarshalBinary disagree", p.Opcode())
+	}
+	decoded, err := Decode(encoded)
+	if err != nil {
+		return fmt.Errorf("decoding %s: %w", p.Opcode(), err)
+	}
+	if !reflect.DeepEqual(normalize(decoded), normalize(p)) {
+		return fmt.Errorf("%s did not round trip: %+v != %+v", p.Opcode(), decoded, p)
+	}
+	return nil
+}
+
+// normalize clears the differences between nil and empty slices and maps
+// that the wire format can not carry
+func normalize(p Packet) Packet {
+	switch v := p.(type) {
+	case *Request:
+		c := *v
+		if len(c.Options) == 0 {
+			c.Options = nil
+		}
+		return &c
+	case *Data:
+		c := *v
+		if len(c.Data) == 0 {
+			c.Data = nil
+		}
+		return &c
+	case *Error:
+		c := *v
+		if len(c.ErrorMessage) == 0 {
+			c.ErrorMessage = nil
+		}
+		return &c
+	case *Sack:
+		c := *v
+		if len(c.Ranges) == 0 {
+			c.Ranges = nil
+		}
+		return &c
+	}
+	return p
+}
+
+// tryDecode reports whether a packet decodes, turning a panic in the
+// decoder into an error
+func tryDecode(packet []byte) (accepted bool, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("decoding % x panicked: %v", packet, r)
+		}
+	}()
+	_, decodeErr := Decode(packet)
+	return decodeErr == nil, nil
+}
+
+func mustMarshal(p Packet) []byte {
+	b, err := p.MarshalBinary()
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// randomOptions returns a random set of registered options with valid values
+func randomOptions(rng *rand.Rand) Options {
+	o := Options{}
+	for _, name := range []string{"blksize", "timeout", "tsize", "windowsize", "rollover", "sack", "keyx", "keyy"} {
+		if rng.Intn(2) == 0 {
+			continue
+		}
+		spec, _ := LookupOption(name)
+		if spec.Type == OptionBinary {
+			o[name] = randomBytes(rng, 1+rng.Intn(66))
+			continue
+		}
+		o.SetUint(name, spec.Min+uint64(rng.Int63n(int64(spec.Max-spec.Min+1))))
+	}
+	return o
+}
+
+// randomText returns n random bytes without NUL
+func randomText(rng *rand.Rand, n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(1 + rng.Intn(255))
+	}
+	return b
+}
+
+// randomBytes returns n random bytes, biased towards NUL to exercise the
+// binary safe option encoding
+func randomBytes(rng *rand.Rand, n int) []byte {
+	b := make([]byte, n)
+	rng.Read(b)
+	for i := range b {
+		if rng.Intn(8) == 0 {
+			b[i] = 0
+		}
+	}
+	return b
+}
+
+// randomSack returns a SACK with a random number of random ranges
+func randomSack(rng *rand.Rand) *Sack {
+	s := NewSack(uint16(rng.Intn(1<<16)), nil)
+	for n := rng.Intn(MaxSackRanges + 1); n > 0; n-- {
+		start := uint16(rng.Intn(1 << 16))
+		s.Ranges = append(s.Ranges, SackRange{Start: start, End: start + uint16(rng.Intn(64))})
+	}
+	return s
+}
@@ -0,0 +1,192 @@
+package tftp
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ErrInvalidOption is returned when a registered option carries a value that
+// cannot be decoded or is outside of its valid range
+var ErrInvalidOption = errors.New("invalid option")
+
+// OptionType describes how the value of an option is carried on the wire
+type OptionType uint8
+
+const (
+	// OptionNumeric values are ASCII decimal strings as in RFC 2347-2349 and 7440
+	OptionNumeric OptionType = iota
+	// OptionBinary values are raw bytes sent base64 encoded so that key
+	// material containing 0x00 can not terminate the field early
+	OptionBinary
+)
+
+// OptionSpec describes a registered option, its value type and the range
+// its value has to fall in.  Min and Max only apply to numeric options.
+type OptionSpec struct {
+	Name     string
+	Type     OptionType
+	Min, Max uint64
+}
+
+var registry = make(map[string]OptionSpec)
+
+func init() {
+	RegisterOption(OptionSpec{Name: "blksize", Type: OptionNumeric, Min: 8, Max: 65464})        // RFC 2348
+	RegisterOption(OptionSpec{Name: "timeout", Type: OptionNumeric, Min: 1, Max: 255})          // RFC 2349
+	RegisterOption(OptionSpec{Name: "tsize", Type: OptionNumeric, Min: 0, Max: math.MaxUint32}) // RFC 2349
+	RegisterOption(OptionSpec{Name: "windowsize", Type: OptionNumeric, Min: 1, Max: 65535})     // RFC 7440
+	RegisterOption(OptionSpec{Name: "rollover", Type: OptionNumeric, Min: 0, Max: 1})           // Block number rollover
+	RegisterOption(OptionSpec{Name: "selrepeat", Type: OptionNumeric, Min: 0, Max: 1})          // Selective Repeat instead of Go-Back-N
+	RegisterOption(OptionSpec{Name: "sack", Type: OptionNumeric, Min: 0, Max: 1})               // SACK packets, with Selective Repeat only
+	RegisterOption(OptionSpec{Name: "key", Type: OptionBinary})
+	RegisterOption(OptionSpec{Name: "keyx", Type: OptionBinary})
+	RegisterOption(OptionSpec{Name: "keyy", Type: OptionBinary})
+	RegisterOption(OptionSpec{Name: "cookie", Type: OptionBinary}) // Return-routability cookie
+}
+
+// RegisterOption adds an option to the registry, replacing any option that
+// was registered under the same name.  Names are case insensitive.
+func RegisterOption(spec OptionSpec) {
+	spec.Name = strings.ToLower(spec.Name)
+	registry[spec.Name] = spec
+}
+
+// LookupOption returns the registered spec for an option name
+func LookupOption(name string) (OptionSpec, bool) {
+	spec, ok := registry[strings.ToLower(name)]
+	return spec, ok
+}
+
+// Encode converts a decoded option value into its wire form
+func (s OptionSpec) Encode(value []byte) ([]byte, error) {
+	if s.Type == OptionBinary {
+		return []byte(base64.RawStdEncoding.EncodeToString(value)), nil
+	}
+	if _, err := s.Decode(value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// Decode converts the wire form of an option value into its decoded value,
+// checking numeric values against the valid range of the option
+func (s OptionSpec) Decode(wire []byte) ([]byte, error) {
+	if s.Type == OptionBinary {
+		value, err := base64.RawStdEncoding.DecodeString(string(wire))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %s", ErrInvalidOption, s.Name, err)
+		}
+		return value, nil
+	}
+	v, err := strconv.ParseUint(string(wire), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %q is not a decimal number", ErrInvalidOption, s.Name, wire)
+	}
+	if v < s.Min || v > s.Max {
+		return nil, fmt.Errorf("%w: %s: %d is outside of [%d, %d]", ErrInvalidOption, s.Name, v, s.Min, s.Max)
+	}
+	return wire, nil
+}
+
+// Options holds decoded option values keyed by lower case option name.
+// Numeric options hold their ASCII decimal value and binary options
+// their raw bytes.
+type Options map[string][]byte
+
+// Uint returns the value of a numeric option and whether it is set
+func (o Options) Uint(name string) (uint64, bool) {
+	raw, ok := o[name]
+	if !ok {
+		return 0, false
+	}
+	v, err := strconv.ParseUint(string(raw), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return v, true
+}
+
+// SetUint sets the value of a numeric option
+func (o Options) SetUint(name string, v uint64) {
+	o[name] = strconv.AppendUint(nil, v, 10)
+}
+
+// appendOptions appends the options in wire form to b, sorted by name so
+// the encoding is deterministic.  Unregistered options can not be encoded.
+func appendOptions(b []byte, o Options) ([]byte, error) {
+	names := make([]string, 0, len(o))
+	for name := range o {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		spec, ok := LookupOption(name)
+		if !ok {
+			return nil, fmt.Errorf("%w: %s is not registered", ErrInvalidOption, name)
+		}
+		wire, err := spec.Encode(o[name])
+		if err != nil {
+			return nil, err
+		}
+		b = appendOption(b, spec.Name, wire)
+	}
+	return b, nil
+}
+
+// parseOptions decodes NUL separated name/value pairs.  Unknown options are
+// ignored as required by RFC 2347, registered options with a bad value are
+// rejected, as are unpaired fields, empty names and repeated options.
+func parseOptions(fields [][]byte) (Options, error) {
+	if len(fields)%2 != 0 {
+		return nil, fmt.Errorf("%w: option %q has no value", ErrMalformed, fields[len(fields)-1])
+	}
+	o := make(Options)
+	seen := make(map[string]bool, len(fields)/2)
+	for i := 0; i+1 < len(fields); i += 2 {
+		name := strings.ToLower(string(fields[i]))
+		if name == "" {
+			return nil, fmt.Errorf("%w: empty option name", ErrMalformed)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("%w: option %s is repeated", ErrMalformed, name)
+		}
+		seen[name] = true
+		spec, ok := LookupOption(name)
+		if !ok {
+			continue
+		}
+		value, err := spec.Decode(fields[i+1])
+		if err != nil {
+			return nil, err
+		}
+		o[spec.Name] = value
+	}
+	return o, nil
+}
+
+// appendOption appends a NUL terminated name/value pair to b
+func appendOption(b []byte, name string, value []byte) []byte {
+	b = append(b, name...)
+	b = append(b, 0)
+	b = append(b, value...)
+	return append(b, 0)
+}
+
+// splitFields splits the NUL terminated fields of a packet body.  Every
+// field, including the last one, has to be terminated.
+func splitFields(body []byte) ([][]byte, error) {
+	if len(body) == 0 {
+		return nil, nil
+	}
+	if body[len(body)-1] != 0 {
+		return nil, fmt.Errorf("%w: last field is not NUL terminated", ErrMalformed)
+	}
+	return bytes.Split(body[:len(body)-1], []byte{0}), nil
+}
@@ -10,79 +10,91 @@ import (
 
 // Request represents a TFTP request packet.
 type Request struct {
-	Opcode       TFTPOpcode
-	Filename     []byte
-	Mode         []byte
-	Options      map[string][]byte
-	TransferSize uint16
-	WindowSize   uint16
+	Op       TFTPOpcode
+	Filename []byte
+	Mode     []byte
+	Options  Options
+}
+
+// Opcode returns the opcode of the request, either RRQ or WRQ
+func (r *Request) Opcode() TFTPOpcode {
+	return r.Op
 }
 
 // Parse method parses a byte array into a Request struct
 func (r *Request) Parse(p []byte) error {
-	bs := bytes.Split(p[2:], []byte{0})
+	if len(p) < 2 {
+		return ErrShortPacket
+	}
+	op := TFTPOpcode(binary.BigEndian.Uint16(p[:2]))
+	if op != TFTPOpcodeRRQ && op != TFTPOpcodeWRQ {
+		return fmt.Errorf("%w: expected RRQ or WRQ opcode, got %d", ErrMalformed, uint16(op))
+	}
+	bs, err := splitFields(p[2:])
+	if err != nil {
+		return err
+	}
 	if len(bs) < 2 {
-		return fmt.Errorf("missing filename or mode")
+		return fmt.Errorf("%w: missing filename or mode", ErrMalformed)
+	}
+	if len(bs[0]) == 0 {
+		return fmt.Errorf("%w: empty filename", ErrMalformed)
 	}
-	r.Filename = bs[0]
-	r.Mode = bs[1]
-	if len(bs) < 4 {
-		return nil
+	if len(bs[1]) == 0 {
+		return fmt.Errorf("%w: empty mode", ErrMalformed)
 	}
-	r.Options = make(map[string][]byte)
-	for i := 2; i+1 < len(bs); i += 2 {
-		r.Options[string(bs[i])] = bs[i+1]
+	// Decode the options through the registry, unknown options are dropped
+	options, err := parseOptions(bs[2:])
+	if err != nil {
+		return err
 	}
+	r.Op, r.Filename, r.Mode, r.Options = op, bs[0], bs[1], options
 	return nil
 }
 
 // ToBytes method converts the Request struct to a byte array packet
 func (r *Request) ToBytes() ([]byte, error) {
-	// Check that the filename is not empty
+	return r.AppendTo(nil)
+}
+
+// MarshalBinary encodes the request packet into a new byte slice
+func (r *Request) MarshalBinary() ([]byte, error) {
+	return r.AppendTo(nil)
+}
+
+// AppendTo appends the encoded request packet to packet
+func (r *Request) AppendTo(packet []byte) ([]byte, error) {
+	// Check that the filename and mode are not empty and can be NUL terminated
 	if len(r.Filename) == 0 {
 		return nil, errors.New("empty filename")
 	}
+	if len(r.Mode) == 0 {
+		return nil, errors.New("empty mode")
+	}
+	if bytes.IndexByte(r.Filename, 0) >= 0 || bytes.IndexByte(r.Mode, 0) >= 0 {
+		return nil, fmt.Errorf("%w: filename or mode contains a NUL byte", ErrMalformed)
+	}
 
 	// Construct the request packet
-	var packet []byte
-	packet = append(packet, byte(r.Opcode>>8), byte(r.Opcode))
+	packet = binary.BigEndian.AppendUint16(packet, uint16(r.Op))
 	packet = append(packet, r.Filename...)
 	packet = append(packet, 0)
 	packet = append(packet, r.Mode...)
 	packet = append(packet, 0)
-	for key, value := range r.Options {
-		packet = append(packet, []byte(key)...)
-		packet = append(packet, 0)
-		packet = append(packet, value...)
-		packet = append(packet, 0)
-	}
-	if r.TransferSize > 0 {
-		packet = append(packet, []byte("tsize")...)
-		packet = append(packet, 0)
-		sizeBytes := make([]byte, 2)
-		binary.BigEndian.PutUint16(sizeBytes, r.TransferSize)
-		packet = append(packet, sizeBytes...)
-		packet = append(packet, 0)
-	}
-	if r.WindowSize > 0 {
-		packet = append(packet, []byte("windowsize")...)
-		packet = append(packet, 0)
-		sizeBytes := make([]byte, 2)
-		binary.BigEndian.PutUint16(sizeBytes, r.WindowSize)
-		packet = append(packet, sizeBytes...)
-		packet = append(packet, 0)
-	}
-	return packet, nil
+	// Write the options through the registry
+	return appendOptions(packet, r.Options)
 }
 
 // NewReq method constructs a new Request struct
-func NewReq(filename []byte, mode []byte, transferSize uint32, options map[string][]byte) (*Request, error) {
+func NewReq(filename []byte, mode []byte, transferSize uint32, options Options) (*Request, error) {
 	// Check that the filename is not empty
 	if filename == nil || string(filename) == "" {
 		return nil, errors.New("filename is empty")
 	}
 
-	if !bytes.Equal(mode, []byte("netascii")) && !bytes.Equal(mode, []byte("octet")) && !bytes.Equal(mode, []byte("mail")) {
+	switch NormalizeMode(mode) {
+	case ModeNetascii, ModeOctet, ModeMail:
+	default:
 		return nil, errors.New("invalid mode")
 	}
 	// Construct the request packet
@@ -90,16 +102,16 @@ func NewReq(filename []byte, mode []byte, transferSize uint32, options map[strin
 	if transferSize > 0 {
 		opcode = uint16(TFTPOpcodeWRQ)
 		if options == nil {
-			options = make(map[string][]byte)
+			options = make(Options)
 		}
-		options["tsize"] = []byte(fmt.Sprintf("%d", transferSize))
+		options.SetUint("tsize", uint64(transferSize))
 	} else {
 		opcode = uint16(TFTPOpcodeRRQ)
 	}
 
 	// Construct and return the TFTPRequest struct
 	request := &Request{
-		Opcode:   TFTPOpcode(opcode),
+		Op:       TFTPOpcode(opcode),
 		Filename: filename,
 		Mode:     mode,
 		Options:  options,
@@ -111,12 +123,16 @@ func NewReq(filename []byte, mode []byte, transferSize uint32, options map[strin
 func (r *Request) String() {
 	var optionsString string
 	for key, value := range r.Options {
+		if spec, _ := LookupOption(key); spec.Type == OptionBinary {
+			optionsString += fmt.Sprintf("%s=%x,", key, value)
+			continue
+		}
 		optionsString += fmt.Sprintf("%s=%s,", key, value)
 	}
 	if len(optionsString) > 0 {
 		optionsString = optionsString[:len(optionsString)-1]
 	}
 
-	log.Printf("Opcode=%d, Filename=%s, Mode=%s, Options={%s}, TransferSize=%d, WindowSize=%d\n",
-		r.Opcode, r.Filename, r.Mode, optionsString, r.TransferSize, r.WindowSize)
+	log.Printf("Opcode=%d, Filename=%s, Mode=%s, Options={%s}\n",
+		r.Op, r.Filename, r.Mode, optionsString)
 }
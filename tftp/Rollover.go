@@ -0,0 +1,58 @@
+package tftp
+
+// MaxBlocks is the number of blocks that fit in a transfer before the 16 bit
+// block number has to roll over
+const MaxBlocks = 1<<16 - 1
+
+// WireBlock returns the 16 bit block number sent on the wire for the
+// absolute block number n.  After block 65535 the counter rolls over to the
+// negotiated rollover value, 0 or 1.
+func WireBlock(n uint64, rollover uint16) uint16 {
+	if n <= MaxBlocks {
+		return uint16(n)
+	}
+	period := uint64(1<<16) - uint64(rollover)
+	return uint16(uint64(rollover) + (n-(1<<16))%period)
+}
+
+// AbsoluteBlock unwraps a wire block number into the absolute block number
+// closest to ref, the block the caller currently expects.  Peers never have
+// more than a window of blocks in flight, so the closest match is the
+// right one.
+func AbsoluteBlock(wire uint16, ref uint64, rollover uint16) uint64 {
+	best, found := uint64(0), false
+	consider := func(n uint64) {
+		if !found || distance(n, ref) < distance(best, ref) {
+			best, found = n, true
+		}
+	}
+
+	// Before the first rollover the wire number is the block number
+	if wire != 0 || rollover == 0 {
+		consider(uint64(wire))
+	}
+
+	// After it every period of 65536-rollover blocks reuses the wire numbers
+	if wire >= rollover {
+		period := uint64(1<<16) - uint64(rollover)
+		first := uint64(1<<16) + uint64(wire-rollover)
+		k := uint64(0)
+		if ref > first {
+			k = (ref - first + period/2) / period
+		}
+		consider(first + k*period)
+		consider(first + (k+1)*period)
+		if k > 0 {
+			consider(first + (k-1)*period)
+		}
+	}
+	return best
+}
+
+// distance returns the absolute difference between two block numbers
+func distance(a, b uint64) uint64 {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
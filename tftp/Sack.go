@@ -0,0 +1,89 @@
+package tftp
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// MaxSackRanges caps the ranges a SACK carries, a receiver holding more
+// reports the ones closest to the cumulative block
+const MaxSackRanges = 32
+
+// SackRange is a run of blocks, Start to End inclusive, that a receiver
+// holds past a gap
+type SackRange struct {
+	Start, End uint16
+}
+
+// Sack represents a SACK packet, a selective acknowledgement.  It
+// acknowledges every block up to BlockNumber like an ACK does and the
+// blocks in Ranges, which arrived past a gap, so the sender only resends the
+// blocks missing in between.  It is only sent when the sack option was
+// negotiated.
+//
+//	2 bytes  2 bytes   2 bytes   2 bytes        2 bytes   2 bytes
+//	| 09 |  Block  |  Start 1 |  End 1  | ... |  Start n |  End n  |
+type Sack struct {
+	BlockNumber uint16
+	Ranges      []SackRange
+}
+
+// NewSack method constructs a new Sack struct
+func NewSack(blockNumber uint16, ranges []SackRange) *Sack {
+	return &Sack{BlockNumber: blockNumber, Ranges: ranges}
+}
+
+// Opcode returns the SACK opcode
+func (s *Sack) Opcode() TFTPOpcode {
+	return TFTPOpcodeSACK
+}
+
+// Parse method parses a byte array into a Sack struct.  The ranges reuse
+// the slice of the previous packet parsed into s.
+func (s *Sack) Parse(packet []byte) error {
+	if err := checkHeader(packet, TFTPOpcodeSACK, 4); err != nil {
+		return err
+	}
+	body := packet[4:]
+	if len(body)%4 != 0 {
+		return fmt.Errorf("%w: SACK ranges are %d bytes, not a multiple of 4", ErrMalformed, len(body))
+	}
+	if len(body)/4 > MaxSackRanges {
+		return fmt.Errorf("%w: SACK carries %d ranges, at most %d allowed", ErrMalformed, len(body)/4, MaxSackRanges)
+	}
+
+	s.BlockNumber = binary.BigEndian.Uint16(packet[2:4])
+	s.Ranges = s.Ranges[:0]
+	for ; len(body) > 0; body = body[4:] {
+		s.Ranges = append(s.Ranges, SackRange{
+			Start: binary.BigEndian.Uint16(body[0:2]),
+			End:   binary.BigEndian.Uint16(body[2:4]),
+		})
+	}
+	return nil
+}
+
+// AppendTo appends the encoded Sack packet to b
+func (s *Sack) AppendTo(b []byte) ([]byte, error) {
+	if len(s.Ranges) > MaxSackRanges {
+		return nil, fmt.Errorf("SACK carries %d ranges, at most %d allowed", len(s.Ranges), MaxSackRanges)
+	}
+	b = binary.BigEndian.AppendUint16(b, uint16(TFTPOpcodeSACK))
+	b = binary.BigEndian.AppendUint16(b, s.BlockNumber)
+	for _, r := range s.Ranges {
+		b = binary.BigEndian.AppendUint16(b, r.Start)
+		b = binary.BigEndian.AppendUint16(b, r.End)
+	}
+	return b, nil
+}
+
+// MarshalBinary encodes the Sack packet into a new byte slice
+func (s *Sack) MarshalBinary() ([]byte, error) {
+	return s.AppendTo(make([]byte, 0, 4+4*len(s.Ranges)))
+}
+
+// ToBytes method converts the Sack struct to a byte array packet
+func (s *Sack) ToBytes() []byte {
+	packet, _ := s.AppendTo(make([]byte, 0, 4+4*len(s.Ranges)))
+	return packet
+}
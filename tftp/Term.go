@@ -0,0 +1,112 @@
+package tftp
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// TermReason says why a session was torn down
+type TermReason uint16
+
+// Reasons carried by TERM packets
+const (
+	TermUnspecified TermReason = 0 // No reason given
+	TermCancelled   TermReason = 1 // The transfer was cancelled by the user or an operator
+	TermShutdown    TermReason = 2 // The peer is shutting down
+	TermError       TermReason = 3 // The peer hit an error it can not recover from
+	TermTimeout     TermReason = 4 // The peer gave up waiting for us
+)
+
+// String returns a readable name for the reason
+func (r TermReason) String() string {
+	switch r {
+	case TermUnspecified:
+		return "unspecified"
+	case TermCancelled:
+		return "cancelled"
+	case TermShutdown:
+		return "shutdown"
+	case TermError:
+		return "error"
+	case TermTimeout:
+		return "timeout"
+	default:
+		return fmt.Sprintf("reason %d", uint16(r))
+	}
+}
+
+// termFlagAck marks a TERM that acknowledges the peer's TERM
+const termFlagAck = 1
+
+// Term represents a TERM packet, sent by either side to tear down a transfer.
+// The side that aborts sends a TERM with its reason and the peer answers
+// with the same reason and Ack set, after which both release the session.
+//
+//	2 bytes  2 bytes  2 bytes
+//	| 08 |  Reason  |  Flags  |
+type Term struct {
+	Reason TermReason
+	Ack    bool // Acknowledges a TERM from the peer
+}
+
+// NewTerm method constructs a new Term struct
+func NewTerm(reason TermReason) *Term {
+	return &Term{Reason: reason}
+}
+
+// NewTermAck constructs the acknowledgement for a TERM sent with reason
+func NewTermAck(reason TermReason) *Term {
+	return &Term{Reason: reason, Ack: true}
+}
+
+// Opcode returns the TERM opcode
+func (t *Term) Opcode() TFTPOpcode {
+	return TFTPOpcodeTERM
+}
+
+// Error makes a received TERM usable as the error that ended a transfer
+func (t *Term) Error() string {
+	return "tftp: session terminated: " + t.Reason.String()
+}
+
+// Parse method parses a byte array into a Term struct
+func (t *Term) Parse(packet []byte) error {
+	// Check the opcode and that the packet is exactly 6 bytes long
+	if err := checkHeader(packet, TFTPOpcodeTERM, 6); err != nil {
+		return err
+	}
+	if len(packet) != 6 {
+		return fmt.Errorf("%w: TERM packet has %d trailing bytes", ErrMalformed, len(packet)-6)
+	}
+	flags := binary.BigEndian.Uint16(packet[4:6])
+	if flags&^termFlagAck != 0 {
+		return fmt.Errorf("%w: unknown TERM flags %#x", ErrMalformed, flags)
+	}
+
+	t.Reason = TermReason(binary.BigEndian.Uint16(packet[2:4]))
+	t.Ack = flags&termFlagAck != 0
+	return nil
+}
+
+// AppendTo appends the encoded Term packet to b
+func (t *Term) AppendTo(b []byte) ([]byte, error) {
+	var flags uint16
+	if t.Ack {
+		flags |= termFlagAck
+	}
+	b = binary.BigEndian.AppendUint16(b, uint16(TFTPOpcodeTERM))
+	b = binary.BigEndian.AppendUint16(b, uint16(t.Reason))
+	b = binary.BigEndian.AppendUint16(b, flags)
+	return b, nil
+}
+
+// MarshalBinary encodes the Term packet into a new byte slice
+func (t *Term) MarshalBinary() ([]byte, error) {
+	return t.AppendTo(make([]byte, 0, 6))
+}
+
+// ToBytes method converts the Term struct to a byte array packet
+func (t *Term) ToBytes() []byte {
+	packet, _ := t.AppendTo(make([]byte, 0, 6))
+	return packet
+}